@@ -4,12 +4,15 @@ type apu struct {
 	S1, S2 square
 	triangle
 	noise
+	dmc
 
 	Odd        bool
 	FC         byte
 	FT         byte
 	IrqDisable bool
 	Interrupt  bool
+	// PAL selects the noise and DMC periods of the PAL APU.
+	PAL bool
 }
 
 type noise struct {
@@ -18,6 +21,8 @@ type noise struct {
 	length
 	Short bool
 	Shift uint16
+	// Inverted outputs when bit 0 of Shift is set instead of clear.
+	Inverted bool
 
 	Enable bool
 }
@@ -31,6 +36,25 @@ type triangle struct {
 	Enable bool
 }
 
+type dmc struct {
+	timer
+	IrqEnable bool
+	Loop      bool
+	Level     byte
+	Address   uint16 // sample start address
+	Length    uint16 // sample length in bytes
+	Current   uint16 // address of the next sample byte
+	Remaining uint16 // sample bytes remaining
+
+	Buffer  byte
+	Full    bool // Buffer holds a byte not yet shifted out
+	Shift   byte
+	Bits    byte
+	Silence bool
+
+	Interrupt bool
+}
+
 type linear struct {
 	Reload  byte
 	Halt    bool
@@ -82,17 +106,18 @@ type length struct {
 	Counter byte
 }
 
+// Init puts the APU in its power-on state as the NSF specification expects
+// before the init routine: channel registers cleared, all channels enabled,
+// the frame counter reset in 4-step mode with its IRQ inhibited, and the
+// noise shift register seeded with 1.
 func (a *apu) Init() {
+	*a = apu{PAL: a.PAL}
 	a.S1.sweep.NegOffset = -1
-	for i := uint16(0x4000); i <= 0x400f; i++ {
+	for i := uint16(0x4000); i <= 0x4013; i++ {
 		a.Write(i, 0)
 	}
-	a.Write(0x4010, 0x10)
-	a.Write(0x4011, 0)
-	a.Write(0x4012, 0)
-	a.Write(0x4013, 0)
 	a.Write(0x4015, 0xf)
-	a.Write(0x4017, 0)
+	a.Write(0x4017, 0x40)
 	a.noise.Shift = 1
 }
 
@@ -123,14 +148,23 @@ func (a *apu) Write(v uint16, b byte) {
 	case 0x0c:
 		a.noise.Control1(b)
 	case 0x0e:
-		a.noise.Control2(b)
+		a.noise.Control2(b, a.PAL)
 	case 0x0f:
 		a.noise.Control3(b)
+	case 0x10:
+		a.dmc.Control1(b, a.PAL)
+	case 0x11:
+		a.dmc.Control2(b)
+	case 0x12:
+		a.dmc.Control3(b)
+	case 0x13:
+		a.dmc.Control4(b)
 	case 0x15:
 		a.S1.Disable(b&0x1 == 0)
 		a.S2.Disable(b&0x2 == 0)
 		a.triangle.Disable(b&0x4 == 0)
 		a.noise.Disable(b&0x8 == 0)
+		a.dmc.Disable(b&0x10 == 0)
 	case 0x17:
 		a.FT = 0
 		if b&0x80 != 0 {
@@ -150,13 +184,44 @@ func (n *noise) Control1(b byte) {
 	n.envelope.Control(b)
 }
 
-func (n *noise) Control2(b byte) {
-	n.timer.length = noiseLookup[b&0xf]
+func (n *noise) Control2(b byte, pal bool) {
+	if pal {
+		n.timer.length = noiseLookupPAL[b&0xf]
+	} else {
+		n.timer.length = noiseLookup[b&0xf]
+	}
 	n.Short = b&0x8 != 0
 }
 
 func (n *noise) Control3(b byte) {
-	n.length.Set(b >> 3)
+	if n.Enable {
+		n.length.Set(b >> 3)
+	}
+}
+
+func (d *dmc) Control1(b byte, pal bool) {
+	d.IrqEnable = b&0x80 != 0
+	if !d.IrqEnable {
+		d.Interrupt = false
+	}
+	d.Loop = b&0x40 != 0
+	if pal {
+		d.timer.length = dmcLookupPAL[b&0xf] - 1
+	} else {
+		d.timer.length = dmcLookup[b&0xf] - 1
+	}
+}
+
+func (d *dmc) Control2(b byte) {
+	d.Level = b & 0x7f
+}
+
+func (d *dmc) Control3(b byte) {
+	d.Address = 0xc000 | uint16(b)<<6
+}
+
+func (d *dmc) Control4(b byte) {
+	d.Length = uint16(b)<<4 | 1
 }
 
 func (t *triangle) Control1(b byte) {
@@ -177,7 +242,9 @@ func (t *triangle) Control2(b byte) {
 func (t *triangle) Control3(b byte) {
 	t.timer.length &= 0xff
 	t.timer.length |= uint16(b&0x7) << 8
-	t.length.Set(b >> 3)
+	if t.Enable {
+		t.length.Set(b >> 3)
+	}
 	t.linear.Halt = true
 }
 
@@ -199,7 +266,9 @@ func (s *square) Control3(b byte) {
 func (s *square) Control4(b byte) {
 	s.timer.length &= 0xff
 	s.timer.length |= uint16(b&0x7) << 8
-	s.length.Set(b >> 3)
+	if s.Enable {
+		s.length.Set(b >> 3)
+	}
 
 	s.envelope.Start = true
 	s.duty.Counter = 0
@@ -252,6 +321,20 @@ func (n *noise) Disable(b bool) {
 	}
 }
 
+func (d *dmc) Disable(b bool) {
+	d.Interrupt = false
+	if b {
+		d.Remaining = 0
+	} else if d.Remaining == 0 {
+		d.Restart()
+	}
+}
+
+func (d *dmc) Restart() {
+	d.Current = d.Address
+	d.Remaining = d.Length
+}
+
 func (a *apu) Read(v uint16) byte {
 	var b byte
 	if v == 0x4015 {
@@ -267,10 +350,16 @@ func (a *apu) Read(v uint16) byte {
 		if a.noise.length.Counter > 0 {
 			b |= 0x8
 		}
+		if a.dmc.Remaining > 0 {
+			b |= 0x10
+		}
 		if a.Interrupt {
 			b |= 0x40
 			a.Interrupt = false
 		}
+		if a.dmc.Interrupt {
+			b |= 0x80
+		}
 	}
 	return b
 }
@@ -355,6 +444,57 @@ func (n *noise) Clock() {
 	}
 }
 
+func (d *dmc) Clock() {
+	if !d.timer.Clock() {
+		return
+	}
+	if !d.Silence {
+		if d.Shift&0x1 != 0 {
+			if d.Level <= 125 {
+				d.Level += 2
+			}
+		} else if d.Level >= 2 {
+			d.Level -= 2
+		}
+	}
+	d.Shift >>= 1
+	if d.Bits > 0 {
+		d.Bits--
+	}
+	if d.Bits == 0 {
+		d.Bits = 8
+		d.Silence = !d.Full
+		if d.Full {
+			d.Shift = d.Buffer
+			d.Full = false
+		}
+	}
+}
+
+// Fetch returns the address of the next sample byte and whether the sample
+// buffer is waiting for it.
+func (d *dmc) Fetch() (uint16, bool) {
+	return d.Current, !d.Full && d.Remaining > 0
+}
+
+// Fill loads the sample byte requested by Fetch into the sample buffer.
+func (d *dmc) Fill(b byte) {
+	d.Buffer = b
+	d.Full = true
+	d.Current++
+	if d.Current == 0 {
+		d.Current = 0x8000
+	}
+	d.Remaining--
+	if d.Remaining == 0 {
+		if d.Loop {
+			d.Restart()
+		} else if d.IrqEnable {
+			d.Interrupt = true
+		}
+	}
+}
+
 func (a *apu) Step() {
 	if a.Odd {
 		if a.S1.Enable {
@@ -371,6 +511,7 @@ func (a *apu) Step() {
 	if a.triangle.Enable {
 		a.triangle.Clock()
 	}
+	a.dmc.Clock()
 }
 
 func (a *apu) FrameStep() {
@@ -423,18 +564,55 @@ func (l *length) Clock() {
 }
 
 func (a *apu) Volume() float32 {
-	p := pulseOut[a.S1.Volume()+a.S2.Volume()]
-	t := tndOut[3*a.triangle.Volume()+2*a.noise.Volume()]
-	return p + t
+	p, t := a.Mix()
+	return pulseOut[p] + tndOut[t]
+}
+
+// Mix returns the linear channel sums that index the pulse and
+// triangle/noise/DMC mixer tables.
+func (a *apu) Mix() (pulse, tnd uint8) {
+	pulse = a.S1.Volume() + a.S2.Volume()
+	tnd = 3*a.triangle.Volume() + 2*a.noise.Volume() + a.dmc.Volume()
+	return
+}
+
+// MixSnapshot holds the intermediate mixer values of a sample.
+type MixSnapshot struct {
+	// Pulse is the sum of the pulse channel outputs, 0-30.
+	Pulse int
+	// TND is 3*triangle + 2*noise + DMC, 0-202.
+	TND int
+	// PulseOut and TNDOut are Pulse and TND after the nonlinear mixer
+	// curves. Output is their sum.
+	PulseOut float32
+	TNDOut   float32
+	Output   float32
+}
+
+func (a *apu) Snapshot() MixSnapshot {
+	p, t := a.Mix()
+	return MixSnapshot{
+		Pulse:    int(p),
+		TND:      int(t),
+		PulseOut: pulseOut[p],
+		TNDOut:   tndOut[t],
+		Output:   pulseOut[p] + tndOut[t],
+	}
 }
 
 func (n *noise) Volume() uint8 {
-	if n.Enable && n.length.Counter > 0 && n.Shift&0x1 != 0 {
+	// The hardware mutes the channel while bit 0 of the shift register is
+	// set.
+	if n.Enable && n.length.Counter > 0 && (n.Shift&0x1 == 0) != n.Inverted {
 		return n.envelope.Output()
 	}
 	return 0
 }
 
+func (d *dmc) Volume() uint8 {
+	return d.Level
+}
+
 func (t *triangle) Volume() uint8 {
 	if t.Enable && t.linear.Counter > 0 && t.length.Counter > 0 {
 		return triLookup[t.SI]
@@ -507,6 +685,24 @@ var (
 		0x0ca, 0x0fe, 0x17c, 0x1fc,
 		0x2fa, 0x3f8, 0x7f2, 0xfe4,
 	}
+	noiseLookupPAL = [...]uint16{
+		0x004, 0x008, 0x00e, 0x01e,
+		0x03c, 0x058, 0x076, 0x094,
+		0x0bc, 0x0ec, 0x162, 0x1d8,
+		0x2c4, 0x3b0, 0x762, 0xec2,
+	}
+	dmcLookup = [...]uint16{
+		428, 380, 340, 320,
+		286, 254, 226, 214,
+		190, 160, 142, 128,
+		106, 84, 72, 54,
+	}
+	dmcLookupPAL = [...]uint16{
+		398, 354, 316, 298,
+		276, 236, 210, 198,
+		176, 148, 132, 118,
+		98, 78, 66, 50,
+	}
 )
 
 func init() {
@@ -0,0 +1,171 @@
+package nsf
+
+import "testing"
+
+func TestDisableChannel(t *testing.T) {
+	var r ram
+	r.A.Init()
+	r.Write(0x4008, 0x7f) // linear counter reload
+	r.Write(0x400a, 0x40)
+	r.Write(0x400b, 0x08) // length counter load
+	r.A.FrameStep()
+	if r.A.triangle.Volume() == 0 {
+		t.Fatal("triangle silent after enabling")
+	}
+	if r.Read(0x4015)&0x4 == 0 {
+		t.Fatal("triangle length counter not reported")
+	}
+
+	r.Write(0x4015, 0xb)
+	if v := r.A.triangle.Volume(); v != 0 {
+		t.Fatalf("triangle volume %d after disable", v)
+	}
+	if r.A.triangle.length.Counter != 0 {
+		t.Fatal("length counter not cleared")
+	}
+	if r.Read(0x4015)&0x4 != 0 {
+		t.Fatal("triangle still reported active")
+	}
+
+	// Length counters cannot be loaded while the channel is disabled.
+	r.Write(0x400b, 0x08)
+	if r.A.triangle.length.Counter != 0 {
+		t.Fatal("length counter loaded while disabled")
+	}
+}
+
+func TestPowerOn(t *testing.T) {
+	n, err := ReadNSF(testHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	a := &n.ram.A
+	if a.noise.Shift != 1 {
+		t.Fatalf("noise shift register = %#x, want 1", a.noise.Shift)
+	}
+	if a.FC != 4 || a.FT != 0 || !a.IrqDisable {
+		t.Fatalf("frame counter FC=%d FT=%d IrqDisable=%v", a.FC, a.FT, a.IrqDisable)
+	}
+	// Constant volume 15, shortest period, length counter loaded.
+	n.ram.Write(0x400c, 0x3f)
+	n.ram.Write(0x400e, 0x00)
+	n.ram.Write(0x400f, 0x08)
+	audible := false
+	for i := 0; i < 100; i++ {
+		a.Step()
+		if a.noise.Volume() != 0 {
+			audible = true
+		}
+	}
+	if !audible {
+		t.Fatal("noise channel silent after init")
+	}
+	if a.noise.Shift == 0 {
+		t.Fatal("noise shift register stuck at 0")
+	}
+}
+
+func TestDMC(t *testing.T) {
+	var r ram
+	r.A.Init()
+	r.M[0xc040] = 0xff
+	r.Write(0x4010, 0x0f) // fastest rate, no loop
+	r.Write(0x4012, 0x01) // $C040
+	r.Write(0x4013, 0x00) // 1 byte
+	r.Write(0x4015, 0x10)
+	if r.Read(0x4015)&0x10 == 0 {
+		t.Fatal("DMC not active after enable")
+	}
+	a, ok := r.A.dmc.Fetch()
+	if !ok || a != 0xc040 {
+		t.Fatalf("fetch %04X %v, want C040 true", a, ok)
+	}
+	r.A.dmc.Fill(r.Read(a))
+	if r.Read(0x4015)&0x10 != 0 {
+		t.Fatal("DMC active after last byte")
+	}
+	for i := 0; i < 54*16; i++ {
+		r.A.Step()
+	}
+	if r.A.dmc.Volume() != 16 {
+		t.Fatalf("DMC level %d, want 16", r.A.dmc.Volume())
+	}
+}
+
+func TestDMCStealsCycles(t *testing.T) {
+	code := []byte{
+		// init: loop a one byte sample at the fastest rate.
+		0xa9, 0x4f, 0x8d, 0x10, 0x40, // LDA #$4F; STA $4010
+		0xa9, 0x00, 0x8d, 0x12, 0x40, // LDA #$00; STA $4012
+		0x8d, 0x13, 0x40, // STA $4013
+		0xa9, 0x1f, 0x8d, 0x15, 0x40, // LDA #$1F; STA $4015
+		0x60, // RTS
+		// play ($8013): busy for longer than a frame, then count the call.
+		0xa2, 0x18, // LDX #24
+		0xa0, 0x00, // LDY #0
+		0x88,       // DEY
+		0xd0, 0xfd, // BNE -3
+		0xca,       // DEX
+		0xd0, 0xf8, // BNE -8
+		0xe6, 0x10, // INC $10
+		0xd0, 0x02, // BNE +2
+		0xe6, 0x11, // INC $11
+		0x60, // RTS
+	}
+	plays := func(steal bool) int {
+		b := append(testHeader()[:nsfHEADER_LEN], code...)
+		b[nsfPLAY] = 0x13
+		n, err := ReadNSF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.DMCStealsCycles = steal
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		n.Play(int(n.SampleRate) * 5)
+		return int(n.ram.M[0x10]) | int(n.ram.M[0x11])<<8
+	}
+	with, without := plays(true), plays(false)
+	if with == 0 || with >= without {
+		t.Fatalf("got %d play calls with stealing, %d without", with, without)
+	}
+}
+
+func TestNoiseInverted(t *testing.T) {
+	var a, b noise
+	for _, n := range []*noise{&a, &b} {
+		n.Enable = true
+		n.Shift = 1
+		n.Control1(0x3f)
+		n.Control3(0x08)
+	}
+	b.Inverted = true
+	for i := 0; i < 100; i++ {
+		if (a.Volume() == 0) == (b.Volume() == 0) {
+			t.Fatalf("step %d: shift %#x: volumes %d and %d", i, a.Shift, a.Volume(), b.Volume())
+		}
+		a.Clock()
+		b.Clock()
+	}
+	if a.Shift != b.Shift {
+		t.Fatal("shift registers diverged")
+	}
+}
+
+func TestPALPeriods(t *testing.T) {
+	var r ram
+	r.A.PAL = true
+	r.A.Init()
+	if !r.A.PAL {
+		t.Fatal("Init cleared PAL")
+	}
+	r.Write(0x400e, 0x0f)
+	r.Write(0x4010, 0x00)
+	if r.A.noise.timer.length != 3778 || r.A.dmc.timer.length != 397 {
+		t.Fatalf("noise period %d, DMC period %d", r.A.noise.timer.length, r.A.dmc.timer.length)
+	}
+}
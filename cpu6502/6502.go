@@ -18,7 +18,10 @@
 package cpu6502
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"runtime"
 	"strings"
@@ -36,7 +39,12 @@ type Instruction struct {
 	TIM             timing
 }
 
-var Optable [0xff + 1]*Op
+// OpTable maps each opcode to its operation.
+type OpTable [0xff + 1]*Op
+
+// Optable is the NMOS 6502 opcode table, including the unofficial
+// opcodes. New gives each Cpu its own copy.
+var Optable OpTable
 
 type Func func(*Cpu, byte, uint16, Mode)
 
@@ -44,10 +52,21 @@ type Op struct {
 	Mode
 	F Func
 	T int
+	// Cross is set if an indexed read that crosses a page boundary takes
+	// an extra cycle.
+	Cross bool
+	// NoRead is set if the instruction does not use the value at its
+	// operand address, so Step does not read it.
+	NoRead bool
 }
 
 func (o *Op) String() string {
-	n := runtime.FuncForPC(reflect.ValueOf(o.F).Pointer()).Name()
+	return funcName(o.F)
+}
+
+// funcName returns the name of f, which is its mnemonic.
+func funcName(f Func) string {
+	n := runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()
 	n = n[strings.LastIndex(n, ".")+1:]
 	return n
 }
@@ -78,6 +97,12 @@ func (m Mode) Format() string {
 		return "($%02[3]X),Y"
 	case MODE_BRA:
 		return "$%02[1]X"
+	case MODE_ZPIND:
+		return "($%02[3]X)"
+	case MODE_ZPREL:
+		return "$%02[3]X,$%02[2]X"
+	case MODE_ABSXIND:
+		return "($%04[3]X,X)"
 	default:
 		return ""
 	}
@@ -96,6 +121,9 @@ const (
 	MODE_INDY
 	MODE_SNGL
 	MODE_BRA
+	MODE_ZPIND
+	MODE_ZPREL // zero page address and branch offset of BBR and BBS
+	MODE_ABSXIND
 
 	IRQ   = 0xfffe
 	RESET = 0xfffc
@@ -116,14 +144,80 @@ type Cpu struct {
 	M Memory
 	T Ticker
 
+	// Ops is the opcode table used by Step. If nil, Optable is used.
+	Ops *OpTable
+
+	// Variant is the instruction set of Ops.
+	Variant Variant
+
 	DisableDecimal bool
 
+	// FixIndirectJMP disables the NMOS page wrap of JMP ($xxFF), so the
+	// high byte of the target is read from the next page as on the 65C02.
+	FixIndirectJMP bool
+
+	// Halt is set when the CPU traps itself, as with a JMP to its own
+	// address or a JAM opcode. It is cleared by Reset.
+	Halt bool
+
+	// Waiting is set by WAI. While it is set, Step runs one cycle without
+	// executing an instruction. It is cleared by IRQ, NMI, and Reset.
+	Waiting bool
+
+	// JamHook, if non nil, is called with the address of any JAM opcode
+	// executed.
+	JamHook func(pc uint16)
+
+	// TimingOverride, if non nil, replaces the base cycle count of the
+	// opcodes it contains.
+	TimingOverride map[byte]int
+
+	// Trace, if non nil, is called before each instruction is executed
+	// with its address and operation. For hardware interrupts, op is nil.
+	Trace func(pc uint16, op *Op)
+
+	// WatchRead and WatchWrite, if non nil, are called with the address
+	// and value of each memory access made by the CPU.
+	WatchRead  func(addr uint16, val byte)
+	WatchWrite func(addr uint16, val byte)
+
+	// OpenBus is the last value on the data bus, from the most recent
+	// read or write made by the CPU. A Memory with nothing mapped at an
+	// address should return OpenBus from Read to model open bus.
+	OpenBus byte
+
+	// LogFormat is the layout used by StringLog, Debug, and the trace
+	// writer.
+	LogFormat LogFormat
+
 	// If non nil, will record registers on each step.
 	L     []Log
 	LI    int // Log index
 	Debug bool
 
-	stepCycles int
+	// If TrackCoverage is set, Coverage counts the executions of each
+	// opcode.
+	TrackCoverage bool
+	Coverage      [0xff + 1]uint64
+
+	// If Profiling is set, the cycles spent in each opcode are recorded
+	// for Profile.
+	Profiling bool
+
+	// Cycles is the number of cycles run since the last Reset or
+	// ResetCycles.
+	Cycles uint64
+
+	profile     [0xff + 1]int
+	traceWriter io.Writer
+	stepCycles  int
+	breakpoints map[uint16]func(*Cpu)
+}
+
+// SetTraceWriter arranges for each executed instruction to be written to w
+// as a line in the layout of LogFormat. A nil w stops tracing.
+func (c *Cpu) SetTraceWriter(w io.Writer) {
+	c.traceWriter = w
 }
 
 func (c *Cpu) StringLog() string {
@@ -131,7 +225,7 @@ func (c *Cpu) StringLog() string {
 	o := c.LI
 	for i := range c.L {
 		li := (i + o) % len(c.L)
-		fmt.Fprintf(&s, "\n%v", c.L[li])
+		fmt.Fprintf(&s, "\n%s", c.L[li].Text(c.LogFormat))
 	}
 	return s.String()
 }
@@ -143,6 +237,7 @@ type Register struct {
 
 type Log struct {
 	R    Register
+	Pre  Register // registers before execution
 	O    *Op
 	I    byte // instruction
 	C    int  // cycles
@@ -150,7 +245,60 @@ type Log struct {
 	B    byte
 }
 
+// LogFormat selects the text layout of a Log.
+type LogFormat int
+
+const (
+	// LogDefault is the layout of Log.String.
+	LogDefault LogFormat = iota
+	// LogNestest is a compact form of the nestest.log layout, showing
+	// the registers before execution:
+	//	C000  4C F5 C5  JMP $C5F5  A:00 X:00 Y:00 P:24 SP:FD
+	LogNestest
+)
+
+// Text returns l in the layout f.
+func (l Log) Text(f LogFormat) string {
+	if f != LogNestest {
+		return l.String()
+	}
+	code := fmt.Sprintf("%02X", l.I)
+	text := "???"
+	if l.O != nil {
+		var operand uint16
+		switch l.O.Mode {
+		case MODE_IMM, MODE_BRA:
+			operand = uint16(l.B)
+		case MODE_ZP, MODE_ABS:
+			operand = l.V
+		case MODE_ZPREL:
+			operand = l.T | l.V<<8
+		default:
+			operand = l.T
+		}
+		switch l.O.Mode.operands() {
+		case 1:
+			code += fmt.Sprintf(" %02X", operand&0xff)
+		case 2:
+			code += fmt.Sprintf(" %02X %02X", operand&0xff, operand>>8)
+		}
+		text = l.O.String()
+		if l.O.Mode == MODE_BRA && l.I != 0 {
+			text += fmt.Sprintf(" $%04X", l.Pre.PC+2+uint16(int8(l.B)))
+		} else if m := l.operand(); m != "" {
+			text += " " + m
+		}
+	}
+	r := l.Pre
+	return fmt.Sprintf("%04X  %-8s  %s  A:%02X X:%02X Y:%02X P:%02X SP:%02X", r.PC, code, text, r.A, r.X, r.Y, r.P, r.S)
+}
+
 func (l Log) String() string {
+	return fmt.Sprintf("%04X: %02X %3v %-8s p=%08b s=%02X a=%02X x=%02X y=%02X v=%04X b=%02X t=%04X c=%d", l.R.PC, l.I, l.O, l.operand(), l.R.P, l.R.S, l.R.A, l.R.X, l.R.Y, l.V, l.B, l.T, l.C)
+}
+
+// operand returns the formatted operand of the logged instruction.
+func (l Log) operand() string {
 	m := ""
 	if l.O != nil {
 		m = l.O.Mode.Format()
@@ -158,7 +306,52 @@ func (l Log) String() string {
 	if m != "" {
 		m = fmt.Sprintf(m, l.B, l.V, l.T)
 	}
-	return fmt.Sprintf("%04X: %02X %3v %-8s p=%08b s=%02X a=%02X x=%02X y=%02X v=%04X b=%02X t=%04X c=%d", l.R.PC, l.I, l.O, m, l.R.P, l.R.S, l.R.A, l.R.X, l.R.Y, l.V, l.B, l.T, l.C)
+	return m
+}
+
+type logFlags struct {
+	N, V, B, D, I, Z, C bool
+}
+
+type logJSON struct {
+	PC       uint16
+	Opcode   byte
+	Mnemonic string
+	Operand  string
+	A, X, Y  byte
+	S, P     byte
+	Flags    logFlags
+	Cycles   int
+}
+
+// MarshalJSON encodes l with its flags broken out as booleans.
+func (l Log) MarshalJSON() ([]byte, error) {
+	mnemonic := ""
+	if l.O != nil {
+		mnemonic = l.O.String()
+	}
+	p := l.R.P
+	return json.Marshal(logJSON{
+		PC:       l.R.PC,
+		Opcode:   l.I,
+		Mnemonic: mnemonic,
+		Operand:  l.operand(),
+		A:        l.R.A,
+		X:        l.R.X,
+		Y:        l.R.Y,
+		S:        l.R.S,
+		P:        p,
+		Flags: logFlags{
+			N: p&P_N != 0,
+			V: p&P_V != 0,
+			B: p&P_B != 0,
+			D: p&P_D != 0,
+			I: p&P_I != 0,
+			Z: p&P_Z != 0,
+			C: p&P_C != 0,
+		},
+		Cycles: l.C,
+	})
 }
 
 func New(m Memory) *Cpu {
@@ -170,17 +363,86 @@ func New(m Memory) *Cpu {
 		},
 		M: m,
 	}
+	ops := Optable
+	c.Ops = &ops
 	return &c
 }
 
+// Run steps until PC is 0 or the CPU halts.
 func (c *Cpu) Run() {
-	for c.PC != 0 {
+	for c.PC != 0 && !c.Halt {
+		c.Step()
+	}
+}
+
+// ErrMaxCycles is returned when a cycle budget is exhausted.
+var ErrMaxCycles = errors.New("cpu6502: cycle limit reached")
+
+// ErrHalted is returned when the CPU halts before reaching its target.
+var ErrHalted = errors.New("cpu6502: halted")
+
+// RunUntil steps until PC is target and returns the number of cycles used.
+// If more than maxCycles are needed, it stops and returns ErrMaxCycles. If
+// the CPU halts first, it stops and returns ErrHalted.
+func (c *Cpu) RunUntil(target uint16, maxCycles int) (int, error) {
+	cycles := 0
+	for c.PC != target {
+		if c.Halt {
+			return cycles, ErrHalted
+		}
+		if cycles >= maxCycles {
+			return cycles, ErrMaxCycles
+		}
+		cycles += c.Step()
+	}
+	return cycles, nil
+}
+
+// RunCycles steps until at least n cycles have elapsed and returns the
+// number used. Since instructions are not interrupted, this may exceed n.
+func (c *Cpu) RunCycles(n int) int {
+	cycles := 0
+	for cycles < n {
+		cycles += c.Step()
+	}
+	return cycles
+}
+
+// StepN executes n instructions, stopping early if the CPU halts.
+func (c *Cpu) StepN(n int) {
+	for i := 0; i < n && !c.Halt; i++ {
 		c.Step()
 	}
 }
 
+// Reset performs the reset sequence: S is decremented by three as if by
+// pushes that are not written, I is set, and PC is loaded from the RESET
+// vector. It takes 7 cycles.
 func (c *Cpu) Reset() {
-	c.PC = uint16(c.M.Read(RESET+1))<<8 | uint16(c.M.Read(RESET))
+	c.Halt = false
+	c.Waiting = false
+	c.Cycles = 0
+	c.S -= 3
+	c.P |= P_I
+	c.PC = uint16(c.read(RESET+1))<<8 | uint16(c.read(RESET))
+	c.Tick(7)
+}
+
+func (c *Cpu) read(v uint16) byte {
+	b := c.M.Read(v)
+	c.OpenBus = b
+	if c.WatchRead != nil {
+		c.WatchRead(v, b)
+	}
+	return b
+}
+
+func (c *Cpu) write(v uint16, b byte) {
+	if c.WatchWrite != nil {
+		c.WatchWrite(v, b)
+	}
+	c.OpenBus = b
+	c.M.Write(v, b)
 }
 
 func (c *Cpu) Tick(i int) {
@@ -192,101 +454,128 @@ func (c *Cpu) Tick(i int) {
 			c.T.Tick()
 		}
 		c.stepCycles++
+		c.Cycles++
+	}
+}
+
+// CoverageReport returns the number of executions recorded in Coverage for
+// each mnemonic.
+func (c *Cpu) CoverageReport() map[string]uint64 {
+	r := make(map[string]uint64)
+	for i, n := range c.Coverage {
+		if n > 0 {
+			r[c.ops()[i].String()] += n
+		}
 	}
+	return r
 }
 
-func (c *Cpu) Step() {
+// Profile returns the number of cycles spent in each mnemonic while
+// Profiling was set.
+func (c *Cpu) Profile() map[string]int {
+	r := make(map[string]int)
+	for i, n := range c.profile {
+		if n > 0 {
+			r[c.ops()[i].String()] += n
+		}
+	}
+	return r
+}
+
+// ResetCycles sets Cycles to 0.
+func (c *Cpu) ResetCycles() {
+	c.Cycles = 0
+}
+
+// SetBreakpoint arranges for fn to be called before the instruction at pc is
+// executed. fn may modify c. It replaces any breakpoint already set at pc.
+func (c *Cpu) SetBreakpoint(pc uint16, fn func(*Cpu)) {
+	if c.breakpoints == nil {
+		c.breakpoints = make(map[uint16]func(*Cpu))
+	}
+	c.breakpoints[pc] = fn
+}
+
+// ClearBreakpoint removes the breakpoint at pc.
+func (c *Cpu) ClearBreakpoint(pc uint16) {
+	delete(c.breakpoints, pc)
+}
+
+func (c *Cpu) ops() *OpTable {
+	if c.Ops == nil {
+		return &Optable
+	}
+	return c.Ops
+}
+
+// Step executes one instruction and returns the number of cycles it took.
+func (c *Cpu) Step() int {
+	if c.Waiting {
+		c.stepCycles = 0
+		c.Tick(1)
+		return c.stepCycles
+	}
+	if fn, ok := c.breakpoints[c.PC]; ok {
+		fn(c)
+	}
+	pre := c.Register
 	pc := c.PC
 	c.stepCycles = 0
-	inst := c.M.Read(c.PC)
+	inst := c.read(c.PC)
 	c.PC++
-	o := Optable[inst]
+	o := c.ops()[inst]
+	if c.Trace != nil {
+		c.Trace(pc, o)
+	}
+	if c.TrackCoverage {
+		c.Coverage[inst]++
+	}
 	var b byte
 	var v, t uint16
+	var cross bool
 	switch o.Mode {
 	case MODE_IMM, MODE_BRA:
-		b = c.M.Read(c.PC)
+		b = c.read(c.PC)
 		c.PC++
-	case MODE_ZP:
-		v = uint16(c.M.Read(c.PC))
-		b = c.M.Read(v)
+	case MODE_ZPREL:
+		t = uint16(c.read(c.PC))
 		c.PC++
-	case MODE_ZPX:
-		t = uint16(c.M.Read(c.PC))
-		v = t + uint16(c.X)
-		v &= 0xff
-		b = c.M.Read(v)
+		b = c.read(t)
+		v = uint16(c.read(c.PC))
 		c.PC++
-	case MODE_ZPY:
-		t = uint16(c.M.Read(c.PC))
-		v = t + uint16(c.Y)
-		v &= 0xff
-		b = c.M.Read(v)
-		c.PC++
-	case MODE_ABS:
-		v = uint16(c.M.Read(c.PC))
-		c.PC++
-		v |= uint16(c.M.Read(c.PC)) << 8
-		c.PC++
-		b = c.M.Read(v)
-	case MODE_ABSX:
-		t = uint16(c.M.Read(c.PC))
-		c.PC++
-		t |= uint16(c.M.Read(c.PC)) << 8
-		c.PC++
-		v = t + uint16(c.X)
-		b = c.M.Read(v)
-	case MODE_ABSY:
-		t = uint16(c.M.Read(c.PC))
-		c.PC++
-		t |= uint16(c.M.Read(c.PC)) << 8
-		c.PC++
-		v = t + uint16(c.Y)
-		b = c.M.Read(v)
-	case MODE_IND:
-		t = uint16(c.M.Read(c.PC))
-		c.PC++
-		t |= uint16(c.M.Read(c.PC)) << 8
-		t1 := t + 1
-		if t&0xff == 0xff {
-			t1 = t & 0xff00
-		}
-		v = uint16(c.M.Read(t)) + uint16(c.M.Read(t1))<<8
-		c.PC++
-	case MODE_INDX:
-		t = uint16(c.M.Read(c.PC))
-		c.PC++
-		v = t + uint16(c.X)
-		v &= 0xff
-		v1 := v + 1
-		v1 &= 0xff
-		v = uint16(c.M.Read(v)) + uint16(c.M.Read(v1))<<8
-		b = c.M.Read(v)
-	case MODE_INDY:
-		t = uint16(c.M.Read(c.PC))
-		c.PC++
-		t1 := t + 1
-		t1 &= 0xff
-		v = uint16(c.M.Read(t)) + uint16(c.M.Read(t1))<<8 + uint16(c.Y)
-		b = c.M.Read(v)
 	case MODE_SNGL:
 		// nothing
 	default:
-		panic("6502: bad address mode")
+		v, t, cross = c.address(o.Mode, c.PC, c.read)
+		c.PC += uint16(o.Mode.operands())
+		if o.Mode != MODE_IND && o.Mode != MODE_ABSXIND && !o.NoRead {
+			b = c.read(v)
+		}
 	}
 	o.F(c, b, v, o.Mode)
-	c.Tick(o.T)
-	if c.L != nil || c.Debug {
+	if n, ok := c.TimingOverride[inst]; ok {
+		c.Tick(n)
+	} else {
+		c.Tick(o.T)
+	}
+	if cross && o.Cross {
+		c.Tick(1)
+	}
+	if c.Profiling {
+		c.profile[inst] += c.stepCycles
+	}
+	if c.L != nil || c.Debug || c.traceWriter != nil {
 		r := c.Register
 		r.PC = pc
 		l := Log{
-			R: r,
-			O: o,
-			I: inst,
-			C: c.stepCycles,
-			V: v,
-			T: t,
-			B: b,
+			R:   r,
+			Pre: pre,
+			O:   o,
+			I:   inst,
+			C:   c.stepCycles,
+			V:   v,
+			T:   t,
+			B:   b,
 		}
 		if c.L != nil {
 			c.L[c.LI] = l
@@ -294,9 +583,91 @@ func (c *Cpu) Step() {
 			c.LI %= len(c.L)
 		}
 		if c.Debug {
-			fmt.Println(l)
+			fmt.Println(l.Text(c.LogFormat))
+		}
+		if c.traceWriter != nil {
+			fmt.Fprintln(c.traceWriter, l.Text(c.LogFormat))
 		}
 	}
+	return c.stepCycles
+}
+
+// address returns the effective address v and the unindexed operand t of
+// the memory operand at pc in mode m, reading memory with read. cross
+// reports whether indexing crossed a page.
+func (c *Cpu) address(m Mode, pc uint16, read func(uint16) byte) (v, t uint16, cross bool) {
+	word := func(a uint16) uint16 {
+		return uint16(read(a)) | uint16(read(a+1))<<8
+	}
+	switch m {
+	case MODE_ZP:
+		v = uint16(read(pc))
+	case MODE_ZPX:
+		t = uint16(read(pc))
+		v = (t + uint16(c.X)) & 0xff
+	case MODE_ZPY:
+		t = uint16(read(pc))
+		v = (t + uint16(c.Y)) & 0xff
+	case MODE_ABS:
+		v = word(pc)
+	case MODE_ABSX:
+		t = word(pc)
+		v = t + uint16(c.X)
+		cross = t&0xff00 != v&0xff00
+	case MODE_ABSY:
+		t = word(pc)
+		v = t + uint16(c.Y)
+		cross = t&0xff00 != v&0xff00
+	case MODE_IND:
+		// The NMOS 6502 does not carry into the high byte when fetching
+		// the target, so JMP ($10FF) reads $10FF and $1000.
+		t = word(pc)
+		t1 := t + 1
+		if t&0xff == 0xff && !c.FixIndirectJMP {
+			t1 = t & 0xff00
+		}
+		v = uint16(read(t)) | uint16(read(t1))<<8
+	case MODE_INDX:
+		t = uint16(read(pc))
+		a := (t + uint16(c.X)) & 0xff
+		v = uint16(read(a)) | uint16(read((a+1)&0xff))<<8
+	case MODE_INDY:
+		t = uint16(read(pc))
+		a := uint16(read(t)) | uint16(read((t+1)&0xff))<<8
+		v = a + uint16(c.Y)
+		cross = a&0xff00 != v&0xff00
+	case MODE_ZPIND:
+		t = uint16(read(pc))
+		v = uint16(read(t)) | uint16(read((t+1)&0xff))<<8
+	case MODE_ABSXIND:
+		t = word(pc)
+		v = word(t + uint16(c.X))
+	default:
+		panic("6502: bad address mode")
+	}
+	return v, t, cross
+}
+
+// EffectiveAddr returns the address that the instruction at PC, in mode
+// m, will access and whether indexing crosses a page. For immediate mode
+// it is the address of the operand, for branches the target, and for
+// MODE_SNGL 0. Memory is read directly, without calling WatchRead.
+func (c *Cpu) EffectiveAddr(m Mode) (addr uint16, crossed bool) {
+	pc := c.PC + 1
+	switch m {
+	case MODE_SNGL:
+		return 0, false
+	case MODE_IMM:
+		return pc, false
+	case MODE_BRA:
+		next := pc + 1
+		addr = next + uint16(int8(c.M.Read(pc)))
+		return addr, next&0xff00 != addr&0xff00
+	case MODE_ZPREL:
+		return uint16(c.M.Read(pc)), false
+	}
+	addr, _, crossed = c.address(m, pc, c.M.Read)
+	return addr, crossed
 }
 
 func (c *Cpu) setNZ(v byte) {
@@ -354,121 +725,195 @@ func (c *Cpu) String() string {
 }
 
 func init() {
+	Optable = newOpTable(nmosNOP, Opcodes, UnofficialOpcodes)
+	for _, i := range jamOpcodes {
+		Optable[i] = &Op{F: JAM, Mode: MODE_SNGL, T: 2}
+	}
+}
+
+// jamOpcodes lock up the NMOS 6502.
+var jamOpcodes = []byte{0x02, 0x12, 0x22, 0x32, 0x42, 0x52, 0x62, 0x72, 0x92, 0xb2, 0xd2, 0xf2}
+
+// newOpTable returns a table of the given instructions. Empty slots are
+// filled by calling fill with the opcode.
+// noRead are the instructions that only write their operand, or use its
+// address as a jump target. Reading it first would have side effects on
+// registers like the N163 data port, and show up in WatchRead.
+var noRead = map[string]bool{
+	"STA": true, "STX": true, "STY": true, "STZ": true,
+	"SAX": true, "SHA": true, "SHX": true, "SHY": true, "TAS": true,
+	"JMP": true, "JSR": true,
+}
+
+func newOpTable(fill func(int) *Op, sets ...[]Instruction) OpTable {
+	var t OpTable
 	populate := func(i Instruction, m Mode, v byte) {
 		if v != null {
-			if Optable[v] != nil {
+			if t[v] != nil {
 				panic(fmt.Sprintf("duplicate instruction %02x", v))
 			} else if i.TIM[m] == 0 {
 				panic("no timing information")
 			}
-			Optable[v] = &Op{
-				F:    i.F,
-				Mode: m,
-				T:    i.TIM[m],
+			t[v] = &Op{
+				F:      i.F,
+				Mode:   m,
+				T:      i.TIM[m],
+				Cross:  i.TIM.cross(),
+				NoRead: noRead[funcName(i.F)],
 			}
 		}
 	}
-	for _, i := range Opcodes {
-		populate(i, MODE_IMM, i.Imm)
-		populate(i, MODE_ZP, i.ZP)
-		populate(i, MODE_ZPX, i.ZPX)
-		populate(i, MODE_ZPY, i.ZPY)
-		populate(i, MODE_ABS, i.ABS)
-		populate(i, MODE_ABSX, i.ABSX)
-		populate(i, MODE_ABSY, i.ABSY)
-		populate(i, MODE_IND, i.IND)
-		populate(i, MODE_INDX, i.INDX)
-		populate(i, MODE_INDY, i.INDY)
-		populate(i, MODE_SNGL, i.SNGL)
-		populate(i, MODE_BRA, i.BRA)
-	}
-	Optable[0] = &Op{
+	for _, set := range sets {
+		for _, i := range set {
+			populate(i, MODE_IMM, i.Imm)
+			populate(i, MODE_ZP, i.ZP)
+			populate(i, MODE_ZPX, i.ZPX)
+			populate(i, MODE_ZPY, i.ZPY)
+			populate(i, MODE_ABS, i.ABS)
+			populate(i, MODE_ABSX, i.ABSX)
+			populate(i, MODE_ABSY, i.ABSY)
+			populate(i, MODE_IND, i.IND)
+			populate(i, MODE_INDX, i.INDX)
+			populate(i, MODE_INDY, i.INDY)
+			populate(i, MODE_SNGL, i.SNGL)
+			populate(i, MODE_BRA, i.BRA)
+		}
+	}
+	t[0] = &Op{
 		F:    BRK,
 		Mode: MODE_BRA,
 		T:    _K[MODE_BRA],
 	}
-	// populate empty slots with NOPs
-	oIM := &Op{
+	for i, o := range t {
+		if o == nil {
+			t[i] = fill(i)
+		}
+	}
+	return t
+}
+
+// NOPs for the empty slots of the NMOS table. Those with an operand read
+// it, taking as long as a read instruction in the same mode.
+var (
+	oIM = &Op{
 		F:    NOP,
 		Mode: MODE_IMM,
 		T:    2,
 	}
-	oZP := &Op{
+	oZP = &Op{
 		F:    NOP,
 		Mode: MODE_ZP,
-		T:    2,
+		T:    3,
 	}
-	oAB := &Op{
+	oAB = &Op{
 		F:    NOP,
 		Mode: MODE_ABS,
-		T:    3,
+		T:    4,
 	}
-	oSN := &Op{
+	oSN = &Op{
 		F:    NOP,
 		Mode: MODE_SNGL,
-		T:    1,
+		T:    2,
 	}
-	oIX := &Op{
+	oIX = &Op{
 		F:    NOP,
 		Mode: MODE_INDX,
-		T:    3,
+		T:    6,
 	}
-	oIY := &Op{
-		F:    NOP,
-		Mode: MODE_INDY,
-		T:    3,
+	oIY = &Op{
+		F:     NOP,
+		Mode:  MODE_INDY,
+		T:     5,
+		Cross: true,
 	}
-	oZX := &Op{
+	oZX = &Op{
 		F:    NOP,
 		Mode: MODE_ZPX,
-		T:    3,
+		T:    4,
 	}
-	oAX := &Op{
-		F:    NOP,
-		Mode: MODE_ABSX,
-		T:    3,
+	oAX = &Op{
+		F:     NOP,
+		Mode:  MODE_ABSX,
+		T:     4,
+		Cross: true,
 	}
-	oAY := &Op{
-		F:    NOP,
-		Mode: MODE_ABSY,
-		T:    3,
+	oAY = &Op{
+		F:     NOP,
+		Mode:  MODE_ABSY,
+		T:     4,
+		Cross: true,
 	}
-	for i, o := range Optable {
-		if o != nil {
-			continue
-		}
-		switch i & 0x1F {
-		case 0x0, 0x2, 0x9, 0xb:
-			Optable[i] = oIM
-		case 0x3:
-			Optable[i] = oIX
-		case 0x4, 0x7:
-			Optable[i] = oZP
-		case 0xc, 0xf:
-			Optable[i] = oAB
-		case 0x12, 0x1a:
-			Optable[i] = oSN
-		case 0x13:
-			Optable[i] = oIY
-		case 0x14, 0x17:
-			Optable[i] = oZX
-		case 0x1b, 0x1e:
-			Optable[i] = oAY
-		case 0x1c, 0x1f:
-			Optable[i] = oAX
-		default:
-			panic("6502: missing NOP")
-		}
+)
+
+// nmosNOP returns the NOP used for the unassigned NMOS opcode i.
+func nmosNOP(i int) *Op {
+	switch i & 0x1F {
+	case 0x0, 0x2, 0x9, 0xb:
+		return oIM
+	case 0x3:
+		return oIX
+	case 0x4, 0x7:
+		return oZP
+	case 0xc, 0xf:
+		return oAB
+	case 0x12, 0x1a:
+		return oSN
+	case 0x13:
+		return oIY
+	case 0x14, 0x17:
+		return oZX
+	case 0x1b, 0x1e:
+		return oAY
+	case 0x1c, 0x1f:
+		return oAX
+	default:
+		panic("6502: missing NOP")
 	}
 }
 
+// Interrupt services a maskable interrupt request. It is equivalent to IRQ.
 func (c *Cpu) Interrupt() {
-	BRK(c, 0, 0, 0)
-	c.Tick(Optable[0].T)
+	c.IRQ()
+}
+
+// IRQ services a maskable interrupt request through the IRQ vector. It
+// returns false and does nothing if the I flag is set.
+func (c *Cpu) IRQ() bool {
+	// An IRQ ends WAI even when it is masked.
+	c.Waiting = false
+	if c.I() {
+		return false
+	}
+	c.interrupt(IRQ)
+	c.Tick(7)
+	return true
+}
+
+// NMI services a non-maskable interrupt through the NMI vector. It is taken
+// regardless of the I flag.
+func (c *Cpu) NMI() {
+	c.Waiting = false
+	c.interrupt(NMI)
+	c.Tick(7)
 }
 
+// interrupt pushes PC and P, with P_B clear as for hardware interrupts, and
+// jumps through vector.
+func (c *Cpu) interrupt(vector uint16) {
+	if c.Trace != nil {
+		c.Trace(c.PC, nil)
+	}
+	c.stackPush(byte(c.PC >> 8))
+	c.stackPush(byte(c.PC & 0xff))
+	c.stackPush((c.P | P_X) &^ P_B)
+	c.P |= P_I
+	c.PC = uint16(c.read(vector)) + uint16(c.read(vector+1))<<8
+}
+
+// BRK is decoded as MODE_BRA so that Step consumes its padding byte. The
+// pushed return address is thus the opcode address plus two, as on hardware.
 func BRK(c *Cpu, b byte, v uint16, m Mode) {
-	a := uint16(c.M.Read(IRQ)) + uint16(c.M.Read(IRQ+1))<<8
+	a := uint16(c.read(IRQ)) + uint16(c.read(IRQ+1))<<8
 	c.stackPush(byte(c.PC >> 8))
 	c.stackPush(byte(c.PC & 0xff))
 	c.stackPush(c.P | P_B)
@@ -479,106 +924,114 @@ func BRK(c *Cpu, b byte, v uint16, m Mode) {
 func NOP(c *Cpu, b byte, v uint16, m Mode) {}
 
 func ADC(c *Cpu, b byte, v uint16, m Mode) {
+	if c.D() && !c.DisableDecimal {
+		c.adcDecimal(b)
+		return
+	}
 	if (c.A^b)&0x80 != 0 {
 		c.CLV()
 	} else {
 		c.SEV()
 	}
-	var a uint16
-	if c.D() && !c.DisableDecimal {
-		a = uint16(c.A&0xf) + uint16(b&0xf)
-		if c.C() {
-			a++
-		}
-		if a >= 10 {
-			a = 0x10 | (a+6)&0xf
-		}
-		a += uint16(c.A&0xf0) + uint16(b&0xf0)
-		if a >= 160 {
-			c.SEC()
-			if c.V() && a >= 0x180 {
-				c.CLV()
-			}
-			a += 0x60
-		} else {
-			c.CLC()
-			if c.V() && a < 0x80 {
-				c.CLV()
-			}
+	a := uint16(c.A) + uint16(b)
+	if c.C() {
+		a++
+	}
+	if a > 0xff {
+		c.SEC()
+		if c.V() && a >= 0x180 {
+			c.CLV()
 		}
 	} else {
-		a = uint16(c.A) + uint16(b)
-		if c.C() {
-			a++
-		}
-		if a > 0xff {
-			c.SEC()
-			if c.V() && a >= 0x180 {
-				c.CLV()
-			}
-		} else {
-			c.CLC()
-			if c.V() && a < 0x80 {
-				c.CLV()
-			}
+		c.CLC()
+		if c.V() && a < 0x80 {
+			c.CLV()
 		}
 	}
 	c.A = byte(a & 0xff)
 	c.setNZ(c.A)
 }
 
+// adcDecimal is ADC in decimal mode. As on the NMOS 6502, Z is set from
+// the binary sum, and N and V from the sum before the high digit is
+// adjusted.
+func (c *Cpu) adcDecimal(b byte) {
+	carry := 0
+	if c.C() {
+		carry = 1
+	}
+	lo := int(c.A&0xf) + int(b&0xf) + carry
+	if lo >= 0xa {
+		lo = (lo+6)&0xf + 0x10
+	}
+	a := int(c.A&0xf0) + int(b&0xf0) + lo
+	signed := int(int8(c.A&0xf0)) + int(int8(b&0xf0)) + lo
+	c.setNZ(c.A + b + byte(carry))
+	if a&0x80 != 0 {
+		c.P |= P_N
+	} else {
+		c.P &= ^P_N
+	}
+	if signed < -128 || signed > 127 {
+		c.SEV()
+	} else {
+		c.CLV()
+	}
+	if a >= 0xa0 {
+		a += 0x60
+	}
+	if a >= 0x100 {
+		c.SEC()
+	} else {
+		c.CLC()
+	}
+	c.A = byte(a)
+}
+
 func SBC(c *Cpu, b byte, v uint16, m Mode) {
+	a, borrow := c.A, 1
+	if c.C() {
+		borrow = 0
+	}
 	if (c.A^b)&0x80 != 0 {
 		c.SEV()
 	} else {
 		c.CLV()
 	}
-	var a uint16
-	if c.D() && !c.DisableDecimal {
-		var w uint16
-		a = 0xf + uint16(c.A&0xf) - uint16(b&0xf)
-		if c.C() {
-			a++
-		}
-		if a < 0x10 {
-			a -= 6
-		} else {
-			w = 0x10
-			a -= 0x10
-		}
-		w += 0xf0 + uint16(c.A&0xf0) - uint16(b&0xf0)
-		if w < 0x100 {
-			c.CLC()
-			if c.V() && w < 0x80 {
-				c.CLV()
-			}
-			w -= 0x60
-		} else {
-			c.SEC()
-			if c.V() && w >= 0x180 {
-				c.CLV()
-			}
+	w := 0xff + uint16(c.A) - uint16(b)
+	if c.C() {
+		w++
+	}
+	if w < 0x100 {
+		c.CLC()
+		if c.V() && w < 0x80 {
+			c.CLV()
 		}
-		a += w
 	} else {
-		a = 0xff + uint16(c.A) - uint16(b)
-		if c.C() {
-			a++
-		}
-		if a < 0x100 {
-			c.CLC()
-			if c.V() && a < 0x80 {
-				c.CLV()
-			}
-		} else {
-			c.SEC()
-			if c.V() && a >= 0x180 {
-				c.CLV()
-			}
+		c.SEC()
+		if c.V() && w >= 0x180 {
+			c.CLV()
 		}
 	}
-	c.A = byte(a & 0xff)
+	c.A = byte(w & 0xff)
 	c.setNZ(c.A)
+	if c.D() && !c.DisableDecimal {
+		c.sbcDecimal(a, b, borrow)
+	}
+}
+
+// sbcDecimal sets A for SBC in decimal mode from the original A. As on the
+// NMOS 6502, the flags are left as those of the binary subtraction.
+func (c *Cpu) sbcDecimal(a, b byte, borrow int) {
+	lo := int(a&0xf) - int(b&0xf) - borrow
+	if lo < 0 {
+		lo = (lo-6)&0xf - 0x10
+	}
+	r := int(a&0xf0) - int(b&0xf0) + lo
+	if r < 0 {
+		r -= 0x60
+	}
+	c.A = byte(r)
 }
 
 func LDA(c *Cpu, b byte, v uint16, m Mode) {
@@ -597,15 +1050,15 @@ func LDY(c *Cpu, b byte, v uint16, m Mode) {
 }
 
 func STA(c *Cpu, b byte, v uint16, m Mode) {
-	c.M.Write(v, c.A)
+	c.write(v, c.A)
 }
 
 func STX(c *Cpu, b byte, v uint16, m Mode) {
-	c.M.Write(v, c.X)
+	c.write(v, c.X)
 }
 
 func STY(c *Cpu, b byte, v uint16, m Mode) {
-	c.M.Write(v, c.Y)
+	c.write(v, c.Y)
 }
 
 func TAX(c *Cpu, b byte, v uint16, m Mode) {
@@ -648,8 +1101,14 @@ func INY(c *Cpu, b byte, v uint16, m Mode) {
 }
 
 func INC(c *Cpu, b byte, v uint16, m Mode) {
-	c.M.Write(v, b+1)
-	c.setNZ(c.M.Read(v))
+	if m == MODE_SNGL {
+		c.A++
+		c.setNZ(c.A)
+		return
+	}
+	c.rmw(v, b, b+1)
+	b++
+	c.setNZ(b)
 }
 
 func DEX(c *Cpu, b byte, v uint16, m Mode) {
@@ -663,14 +1122,22 @@ func DEY(c *Cpu, b byte, v uint16, m Mode) {
 }
 
 func DEC(c *Cpu, b byte, v uint16, m Mode) {
-	c.M.Write(v, b-1)
-	c.setNZ(c.M.Read(v))
+	if m == MODE_SNGL {
+		c.A--
+		c.setNZ(c.A)
+		return
+	}
+	c.rmw(v, b, b-1)
+	b--
+	c.setNZ(b)
 }
 
 func CMP(c *Cpu, b byte, v uint16, m Mode) { c.compare(c.A, b) }
 func CPX(c *Cpu, b byte, v uint16, m Mode) { c.compare(c.X, b) }
 func CPY(c *Cpu, b byte, v uint16, m Mode) { c.compare(c.Y, b) }
 
+// compare sets the flags for r - v: C if r >= v (no borrow), Z if r == v,
+// and N from bit 7 of the wrapped 8-bit difference.
 func (c *Cpu) compare(r, v byte) {
 	if r >= v {
 		c.SEC()
@@ -728,16 +1195,27 @@ func BVS(c *Cpu, b byte, v uint16, m Mode) {
 	}
 }
 
+// jump takes a branch by the signed offset v from the following
+// instruction. It costs a cycle, and another if the target is on a
+// different page.
 func (c *Cpu) jump(v uint16) {
 	c.Tick(1)
+	pc := c.PC
 	if v > 0x7f {
 		c.PC -= 0x100 - v
 	} else {
 		c.PC += v
 	}
+	if pc&0xff00 != c.PC&0xff00 {
+		c.Tick(1)
+	}
 }
 
 func JMP(c *Cpu, b byte, v uint16, m Mode) {
+	// Both forms of JMP are three bytes long.
+	if v == c.PC-3 {
+		c.Halt = true
+	}
 	c.PC = uint16(v)
 }
 
@@ -751,13 +1229,13 @@ func PLA(c *Cpu, b byte, v uint16, m Mode) {
 }
 
 func (c *Cpu) stackPush(b byte) {
-	c.M.Write(uint16(c.S)+0x100, b)
+	c.write(uint16(c.S)+0x100, b)
 	c.S = (c.S - 1) & 0xff
 }
 
 func (c *Cpu) stackPop() byte {
 	c.S = (c.S + 1) & 0xff
-	return c.M.Read(uint16(c.S) + 0x100)
+	return c.read(uint16(c.S) + 0x100)
 }
 
 func JSR(c *Cpu, b byte, v uint16, m Mode) {
@@ -784,74 +1262,94 @@ func ORA(c *Cpu, b byte, v uint16, m Mode) {
 
 func ASL(c *Cpu, b byte, v uint16, m Mode) {
 	if m == MODE_SNGL {
-		c.setCarryBit(c.A, 7)
-		c.A <<= 1
-		c.setNZ(c.A)
+		c.A = c.asl(c.A)
 	} else {
-		c.setCarryBit(c.M.Read(v), 7)
-		c.M.Write(v, c.M.Read(v)<<1)
-		c.setNZ(c.M.Read(v))
+		c.rmw(v, b, c.asl(b))
 	}
 }
 
 func ROL(c *Cpu, b byte, v uint16, m Mode) {
-	var s byte
-	if c.C() {
-		s = 0x01
-	}
 	if m == MODE_SNGL {
-		c.setCarryBit(c.A, 7)
-		c.A <<= 1
-		c.A |= s
-		c.setNZ(c.A)
+		c.A = c.rol(c.A)
 	} else {
-		c.setCarryBit(c.M.Read(v), 7)
-		c.M.Write(v, c.M.Read(v)<<1)
-		c.M.Write(v, c.M.Read(v)|s)
-		c.setNZ(c.M.Read(v))
+		c.rmw(v, b, c.rol(b))
 	}
 }
 
 func LSR(c *Cpu, b byte, v uint16, m Mode) {
 	if m == MODE_SNGL {
-		c.setCarryBit(c.A, 0)
-		c.A >>= 1
-		c.setNZ(c.A)
+		c.A = c.lsr(c.A)
 	} else {
-		c.setCarryBit(c.M.Read(v), 0)
-		c.M.Write(v, c.M.Read(v)>>1)
-		c.setNZ(c.M.Read(v))
+		c.rmw(v, b, c.lsr(b))
 	}
 }
 
 func ROR(c *Cpu, b byte, v uint16, m Mode) {
+	if m == MODE_SNGL {
+		c.A = c.ror(c.A)
+	} else {
+		c.rmw(v, b, c.ror(b))
+	}
+}
+
+// rmw performs the writes of a read-modify-write instruction: the
+// unmodified value b is written back before the result r.
+func (c *Cpu) rmw(v uint16, b, r byte) {
+	c.write(v, b)
+	c.write(v, r)
+}
+
+// asl, rol, lsr, and ror shift b, set the flags, and return the result.
+
+func (c *Cpu) asl(b byte) byte {
+	c.setCarryBit(b, 7)
+	b <<= 1
+	c.setNZ(b)
+	return b
+}
+
+func (c *Cpu) rol(b byte) byte {
 	var s byte
 	if c.C() {
-		s = 0x80
+		s = 0x01
 	}
-	if m == MODE_SNGL {
-		c.setCarryBit(c.A, 0)
-		c.A >>= 1
-		c.A |= s
-		c.setNZ(c.A)
-	} else {
-		c.setCarryBit(c.M.Read(v), 0)
-		c.M.Write(v, c.M.Read(v)>>1)
-		c.M.Write(v, c.M.Read(v)|s)
-		c.setNZ(c.M.Read(v))
+	c.setCarryBit(b, 7)
+	b = b<<1 | s
+	c.setNZ(b)
+	return b
+}
+
+func (c *Cpu) lsr(b byte) byte {
+	c.setCarryBit(b, 0)
+	b >>= 1
+	c.setNZ(b)
+	return b
+}
+
+func (c *Cpu) ror(b byte) byte {
+	var s byte
+	if c.C() {
+		s = 0x80
 	}
+	c.setCarryBit(b, 0)
+	b = b>>1 | s
+	c.setNZ(b)
+	return b
 }
 
 func BIT(c *Cpu, b byte, v uint16, m Mode) {
-	if b&0x80 != 0 {
-		c.P |= P_N
-	} else {
-		c.P &= ^P_N
-	}
-	if b&0x40 != 0 {
-		c.P |= P_V
-	} else {
-		c.P &= ^P_V
+	// The 65C02 immediate form only sets Z.
+	if m != MODE_IMM {
+		if b&0x80 != 0 {
+			c.P |= P_N
+		} else {
+			c.P &= ^P_N
+		}
+		if b&0x40 != 0 {
+			c.P |= P_V
+		} else {
+			c.P &= ^P_V
+		}
 	}
 	if c.A&b != 0 {
 		c.P &= ^P_Z
@@ -915,26 +1413,16 @@ func RTI(c *Cpu, b byte, v uint16, m Mode) {
 	c.PC = uint16(c.stackPop()) + uint16(c.stackPop())<<8
 }
 
-func TRB(c *Cpu, b byte, v uint16, m Mode) {
-	if c.A&c.M.Read(v) != 0 {
-		c.P &= ^P_Z
-	} else {
-		c.P |= P_Z
-	}
-	c.M.Write(v, c.M.Read(v) & ^c.A)
-}
+const null = 0
 
-func TSB(c *Cpu, b byte, v uint16, m Mode) {
-	if c.A&c.M.Read(v) != 0 {
-		c.P &= ^P_Z
-	} else {
-		c.P |= P_Z
-	}
-	c.M.Write(v, c.M.Read(v)|c.A)
+// cross reports whether indexed reads with timing t take an extra cycle
+// when they cross a page. The indexed timings of stores and
+// read-modify-write instructions always include that cycle, which makes
+// them slower than their absolute forms, so only reads match this.
+func (t timing) cross() bool {
+	return t[MODE_ABSX] != 0 && t[MODE_ABSX] == t[MODE_ABS]
 }
 
-const null = 0
-
 var (
 	_1 = timing{
 		MODE_IMM:  2,
@@ -986,6 +1474,7 @@ var (
 	}
 )
 
+// Opcodes are the documented instructions of the NMOS 6502.
 var Opcodes = []Instruction{
 	/* F,  Imm,   ZP,  ZPX,  ZPY,  ABS, ABSX, ABSY,  IND, INDX, INDY, SNGL,  BRA, TIM */
 	{ADC, 0x69, 0x65, 0x75, null, 0x6d, 0x7d, 0x79, null, 0x61, 0x71, null, null, _1},
@@ -1040,14 +1529,14 @@ var Opcodes = []Instruction{
 	{STY, null, 0x84, 0x94, null, 0x8c, null, null, null, null, null, null, null, _3},
 	{TAX, null, null, null, null, null, null, null, null, null, null, 0xaa, null, _2},
 	{TAY, null, null, null, null, null, null, null, null, null, null, 0xa8, null, _2},
-	//{TRB, null, 0x14, null, null, 0x1c, null, null, null, null, null, null, null, _2},
-	//{TSB, null, 0x04, null, null, 0x0c, null, null, null, null, null, null, null, _2},
 	{TSX, null, null, null, null, null, null, null, null, null, null, 0xba, null, _2},
 	{TXA, null, null, null, null, null, null, null, null, null, null, 0x8a, null, _2},
 	{TXS, null, null, null, null, null, null, null, null, null, null, 0x9a, null, _2},
 	{TYA, null, null, null, null, null, null, null, null, null, null, 0x98, null, _2},
+}
 
-	// Unofficial opcodes.
+// UnofficialOpcodes are the undocumented instructions of the NMOS 6502.
+var UnofficialOpcodes = []Instruction{
 	/* F,  Imm,   ZP,  ZPX,  ZPY,  ABS, ABSX, ABSY,  IND, INDX, INDY, SNGL,  BRA, TIM */
 	{LAX, 0xab, 0xa7, null, 0xb7, 0xaf, null, 0xbf, null, 0xa3, 0xb3, null, null, _1},
 	{SAX, null, 0x87, null, 0x97, 0x8f, null, null, null, 0x83, null, null, null, _3},
@@ -1058,6 +1547,17 @@ var Opcodes = []Instruction{
 	{RLA, null, 0x27, 0x37, null, 0x2f, 0x3f, 0x3b, null, 0x23, 0x33, null, null, _2},
 	{SRE, null, 0x47, 0x57, null, 0x4f, 0x5f, 0x5b, null, 0x43, 0x53, null, null, _2},
 	{RRA, null, 0x67, 0x77, null, 0x6f, 0x7f, 0x7b, null, 0x63, 0x73, null, null, _2},
+	{ANC, 0x0b, null, null, null, null, null, null, null, null, null, null, null, _1},
+	{ANC, 0x2b, null, null, null, null, null, null, null, null, null, null, null, _1},
+	{ALR, 0x4b, null, null, null, null, null, null, null, null, null, null, null, _1},
+	{ARR, 0x6b, null, null, null, null, null, null, null, null, null, null, null, _1},
+	{SBX, 0xcb, null, null, null, null, null, null, null, null, null, null, null, _1},
+	{LAS, null, null, null, null, null, null, 0xbb, null, null, null, null, null, _1},
+	{SHA, null, null, null, null, null, null, 0x9f, null, null, 0x93, null, null, _3},
+	{SHX, null, null, null, null, null, null, 0x9e, null, null, null, null, null, _3},
+	{SHY, null, null, null, null, null, 0x9c, null, null, null, null, null, null, _3},
+	{TAS, null, null, null, null, null, null, 0x9b, null, null, null, null, null, _3},
+	{ANE, 0x8b, null, null, null, null, null, null, null, null, null, null, null, _1},
 }
 
 // Unofficial instructions.
@@ -1068,35 +1568,159 @@ func LAX(c *Cpu, b byte, v uint16, m Mode) {
 }
 
 func SAX(c *Cpu, b byte, v uint16, m Mode) {
-	c.M.Write(v, c.X&c.A)
+	c.write(v, c.X&c.A)
 }
 
+// The read-modify-write instructions below feed the value they write to
+// their second operation rather than reading it back, which would not see
+// it if v is a memory-mapped register.
+
 func DCP(c *Cpu, b byte, v uint16, m Mode) {
-	DEC(c, b, v, m)
-	CMP(c, c.M.Read(v), v, m)
+	c.rmw(v, b, b-1)
+	b--
+	CMP(c, b, v, m)
 }
 
 func ISC(c *Cpu, b byte, v uint16, m Mode) {
-	INC(c, b, v, m)
-	SBC(c, c.M.Read(v), v, m)
+	c.rmw(v, b, b+1)
+	b++
+	SBC(c, b, v, m)
 }
 
 func SLO(c *Cpu, b byte, v uint16, m Mode) {
-	ASL(c, b, v, m)
-	ORA(c, c.M.Read(v), v, m)
+	r := c.asl(b)
+	c.rmw(v, b, r)
+	ORA(c, r, v, m)
 }
 
 func RLA(c *Cpu, b byte, v uint16, m Mode) {
-	ROL(c, b, v, m)
-	AND(c, c.M.Read(v), v, m)
+	r := c.rol(b)
+	c.rmw(v, b, r)
+	AND(c, r, v, m)
 }
 
 func SRE(c *Cpu, b byte, v uint16, m Mode) {
-	LSR(c, b, v, m)
-	EOR(c, c.M.Read(v), v, m)
+	r := c.lsr(b)
+	c.rmw(v, b, r)
+	EOR(c, r, v, m)
 }
 
 func RRA(c *Cpu, b byte, v uint16, m Mode) {
-	ROR(c, b, v, m)
-	ADC(c, c.M.Read(v), v, m)
+	r := c.ror(b)
+	c.rmw(v, b, r)
+	ADC(c, r, v, m)
+}
+
+// ANC ANDs A with b and copies bit 7 of the result to C.
+func ANC(c *Cpu, b byte, v uint16, m Mode) {
+	c.A &= b
+	c.setNZ(c.A)
+	c.setCarryBit(c.A, 7)
+}
+
+// ALR ANDs A with b and shifts A right.
+func ALR(c *Cpu, b byte, v uint16, m Mode) {
+	c.A = c.lsr(c.A & b)
+}
+
+// ARR ANDs A with b and rotates A right. C is taken from bit 6 of the
+// result and V from bit 6 xor bit 5. In decimal mode N, Z, and V come from
+// the rotated value and both nibbles are then adjusted as in ADC.
+func ARR(c *Cpu, b byte, v uint16, m Mode) {
+	t := c.A & b
+	var carry byte
+	if c.C() {
+		carry = 0x80
+	}
+	c.A = t>>1 | carry
+	c.setNZ(c.A)
+	if !c.D() || c.DisableDecimal {
+		c.setCarryBit(c.A, 6)
+		if (c.A>>6^c.A>>5)&1 != 0 {
+			c.SEV()
+		} else {
+			c.CLV()
+		}
+		return
+	}
+	if (t^c.A)&0x40 != 0 {
+		c.SEV()
+	} else {
+		c.CLV()
+	}
+	if lo := t & 0xf; lo+lo&1 > 5 {
+		c.A = c.A&0xf0 | (c.A+6)&0xf
+	}
+	if hi := t >> 4; hi+hi&1 > 5 {
+		c.SEC()
+		c.A += 0x60
+	} else {
+		c.CLC()
+	}
+}
+
+// SBX sets X to (A & X) - b, ignoring the carry, and sets the flags as
+// CMP does.
+func SBX(c *Cpu, b byte, v uint16, m Mode) {
+	r := c.A & c.X
+	c.compare(r, b)
+	c.X = r - b
+}
+
+// LAS sets A, X, and S to b & S.
+func LAS(c *Cpu, b byte, v uint16, m Mode) {
+	r := b & c.S
+	c.A, c.X, c.S = r, r, r
+	c.setNZ(r)
+}
+
+// SHA, SHX, SHY, and TAS store a register ANDed with the high byte of the
+// unindexed address plus one. These are unstable on hardware. The stable
+// behavior is implemented; when indexing crosses a page, the high byte of
+// the address written is also replaced by the stored value, as is commonly
+// observed.
+
+func SHA(c *Cpu, b byte, v uint16, m Mode) {
+	c.storeHigh(c.A&c.X, v, v-uint16(c.Y))
+}
+
+func SHX(c *Cpu, b byte, v uint16, m Mode) {
+	c.storeHigh(c.X, v, v-uint16(c.Y))
+}
+
+func SHY(c *Cpu, b byte, v uint16, m Mode) {
+	c.storeHigh(c.Y, v, v-uint16(c.X))
+}
+
+// TAS sets S to A & X and then stores it as SHA does.
+func TAS(c *Cpu, b byte, v uint16, m Mode) {
+	c.S = c.A & c.X
+	c.storeHigh(c.S, v, v-uint16(c.Y))
+}
+
+func (c *Cpu) storeHigh(r byte, v, base uint16) {
+	r &= byte(base>>8) + 1
+	if base&0xff00 != v&0xff00 {
+		v = uint16(r)<<8 | v&0xff
+	}
+	c.write(v, r)
+}
+
+// XAAMagic is the constant ORed into A by ANE. It varies between chips and
+// with temperature; $EE is a common value.
+var XAAMagic byte = 0xee
+
+// ANE, also called XAA, sets A to (A | XAAMagic) & X & b.
+func ANE(c *Cpu, b byte, v uint16, m Mode) {
+	c.A = (c.A | XAAMagic) & c.X & b
+	c.setNZ(c.A)
+}
+
+// JAM halts the CPU with PC left on the opcode.
+func JAM(c *Cpu, b byte, v uint16, m Mode) {
+	c.PC--
+	c.Halt = true
+	if c.JamHook != nil {
+		c.JamHook(c.PC)
+	}
 }
@@ -17,15 +17,14 @@
 package cpu6502
 
 import (
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
 )
 
-type Ram []byte
-
-func (r Ram) Read(v uint16) byte     { return r[v] }
-func (r Ram) Write(v uint16, b byte) { r[v] = b }
-
 // Download from https://github.com/Klaus2m5/6502_65C02_functional_tests/blob/master/bin_files/6502_functional_test.bin
 // GPL, so not included here.
 func TestFunctional(t *testing.T) {
@@ -39,12 +38,12 @@ func TestFunctional(t *testing.T) {
 	c.L = make([]Log, 20)
 	c.PC = 0x0400
 	i := 0
-	for {
-		if c.PC == 0x3399 {
-			break
-		}
+	for !c.Halt {
 		pc := c.PC
 		c.Step()
+		if c.Halt {
+			break
+		}
 		if c.PC == pc {
 			t.Log(c.StringLog())
 			t.Log(c.String())
@@ -57,4 +56,1612 @@ func TestFunctional(t *testing.T) {
 		}
 		i++
 	}
+	if c.PC != 0x3399 {
+		t.Log(c.StringLog())
+		t.Fatalf("trapped at 0x%04X", c.PC)
+	}
+}
+
+func TestNewWithRAM(t *testing.T) {
+	// LDA #$42; STA $0200; LDX $0200
+	c, r := NewWithRAM([]byte{0xa9, 0x42, 0x8d, 0x00, 0x02, 0xae, 0x00, 0x02}, 0x0600)
+	if c.PC != 0x0600 {
+		t.Fatalf("PC = %04X, want 0600", c.PC)
+	}
+	for i := 0; i < 3; i++ {
+		c.Step()
+	}
+	if r[0x0200] != 0x42 {
+		t.Fatalf("$0200 = %02X, want 42", r[0x0200])
+	}
+	if c.X != 0x42 || c.PC != 0x0608 {
+		t.Fatalf("X = %02X, PC = %04X; want 42, 0608", c.X, c.PC)
+	}
+}
+
+func TestTimingOverride(t *testing.T) {
+	// LDA #$01; LDA #$02
+	c, _ := NewWithRAM([]byte{0xa9, 0x01, 0xa9, 0x02}, 0x0600)
+	c.Step()
+	if c.stepCycles != 2 {
+		t.Fatalf("got %d cycles, want 2", c.stepCycles)
+	}
+	c.TimingOverride = map[byte]int{0xa9: 5}
+	c.Step()
+	if c.stepCycles != 5 {
+		t.Fatalf("got %d cycles, want 5", c.stepCycles)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		r, v    byte
+		c, z, n bool
+	}{
+		{0x10, 0x10, true, true, false},
+		{0x00, 0x00, true, true, false},
+		{0xff, 0xff, true, true, false},
+		{0x20, 0x10, true, false, false},
+		{0xff, 0x00, true, false, true},
+		{0x80, 0x00, true, false, true},
+		{0x10, 0x20, false, false, true},
+		{0x00, 0x01, false, false, true},
+		{0x00, 0xff, false, false, false},
+		{0x7f, 0x80, false, false, true},
+	}
+	ops := []struct {
+		name string
+		op   byte
+		set  func(c *Cpu, r byte)
+	}{
+		{"CMP", 0xc9, func(c *Cpu, r byte) { c.A = r }},
+		{"CPX", 0xe0, func(c *Cpu, r byte) { c.X = r }},
+		{"CPY", 0xc0, func(c *Cpu, r byte) { c.Y = r }},
+	}
+	for _, o := range ops {
+		for _, tc := range tests {
+			c, _ := NewWithRAM([]byte{o.op, tc.v}, 0x0600)
+			o.set(c, tc.r)
+			c.Step()
+			if c.C() != tc.c || c.Z() != tc.z || c.N() != tc.n {
+				t.Errorf("%s %02X vs %02X: C=%v Z=%v N=%v, want C=%v Z=%v N=%v",
+					o.name, tc.r, tc.v, c.C(), c.Z(), c.N(), tc.c, tc.z, tc.n)
+			}
+		}
+	}
+}
+
+// recordingRam records the addresses of reads and writes.
+type recordingRam struct {
+	Ram
+	reads  []uint16
+	writes []uint16
+}
+
+func (r *recordingRam) Read(v uint16) byte {
+	r.reads = append(r.reads, v)
+	return r.Ram.Read(v)
+}
+
+func (r *recordingRam) Write(v uint16, b byte) {
+	r.writes = append(r.writes, v)
+	r.Ram.Write(v, b)
+}
+
+func TestJMPIndirect(t *testing.T) {
+	r := &recordingRam{Ram: make(Ram, 0xffff+1)}
+	copy(r.Ram[0x0600:], []byte{0x6c, 0xff, 0x10}) // JMP ($10FF)
+	r.Ram[0x10ff] = 0x34
+	r.Ram[0x1000] = 0x12
+	r.Ram[0x1100] = 0x56
+	c := New(r)
+	c.PC = 0x0600
+	c.Step()
+	if c.PC != 0x1234 {
+		t.Fatalf("PC = %04X, want 1234", c.PC)
+	}
+	want := []uint16{0x0600, 0x0601, 0x0602, 0x10ff, 0x1000}
+	if len(r.reads) != len(want) {
+		t.Fatalf("reads %04X, want %04X", r.reads, want)
+	}
+	for i := range want {
+		if r.reads[i] != want[i] {
+			t.Fatalf("reads %04X, want %04X", r.reads, want)
+		}
+	}
+	if c.stepCycles != 5 {
+		t.Fatalf("%d cycles, want 5", c.stepCycles)
+	}
+}
+
+func TestCountingTicker(t *testing.T) {
+	stack := []byte{
+		0xa2, 0xff, // LDX #$FF
+		0x9a,       // TXS
+		0xa9, 0x01, // LDA #$01
+		0x48, // PHA
+		0x08, // PHP
+		0x28, // PLP
+		0x68, // PLA
+	}
+	c, _ := NewWithRAM(stack, 0x0600)
+	ct := &CountingTicker{Cpu: c}
+	c.T = ct
+	for i := 0; i < 7; i++ {
+		c.Step()
+	}
+	if want := 2 + 2 + 2 + 3 + 3 + 4 + 4; ct.Ticks != want {
+		t.Fatalf("got %d ticks, want %d", ct.Ticks, want)
+	}
+	if len(ct.PCs) != ct.Ticks {
+		t.Fatalf("recorded %d PCs for %d ticks", len(ct.PCs), ct.Ticks)
+	}
+	// LDX #$FF is charged after its operand is fetched.
+	if ct.PCs[0] != 0x0602 || ct.PCs[len(ct.PCs)-1] != 0x0609 {
+		t.Fatalf("PCs %04X", ct.PCs)
+	}
+}
+
+// registerRam is a Ram whose address $10 behaves like a register: reads
+// return Val regardless of what was last written.
+type registerRam struct {
+	Ram
+	Val   byte
+	Wrote []byte
+}
+
+func (r *registerRam) Read(v uint16) byte {
+	if v == 0x10 {
+		return r.Val
+	}
+	return r.Ram.Read(v)
+}
+
+func (r *registerRam) Write(v uint16, b byte) {
+	if v == 0x10 {
+		r.Wrote = append(r.Wrote, b)
+	}
+	r.Ram.Write(v, b)
+}
+
+func TestUnofficialRMW(t *testing.T) {
+	tests := []struct {
+		name  string
+		op    byte
+		a, p  byte // initial A and P
+		m     byte // value read from memory
+		wrote byte // value written back
+		wantA byte
+		wantP byte
+	}{
+		{"SLO", 0x07, 0x01, P_X, 0x81, 0x02, 0x03, P_X | P_C},
+		{"RLA", 0x27, 0xff, P_X | P_C, 0x81, 0x03, 0x03, P_X | P_C},
+		{"RLA carry", 0x27, 0xf0, P_X | P_C, 0x40, 0x81, 0x80, P_X | P_N},
+		{"SRE", 0x47, 0x80, P_X, 0x03, 0x01, 0x81, P_X | P_C | P_N},
+		{"RRA", 0x67, 0x10, P_X | P_C, 0x02, 0x81, 0x91, P_X | P_N},
+		{"RRA carry", 0x67, 0x10, P_X, 0x01, 0x00, 0x11, P_X},
+		{"DCP", 0xc7, 0x00, P_X, 0x01, 0x00, 0x00, P_X | P_Z | P_C},
+		{"ISC", 0xe7, 0x05, P_X | P_C, 0xff, 0x00, 0x05, P_X | P_C},
+	}
+	for _, tc := range tests {
+		r := &registerRam{Ram: make(Ram, 0xffff+1), Val: tc.m}
+		copy(r.Ram[0x0600:], []byte{tc.op, 0x10})
+		c := New(r)
+		c.PC = 0x0600
+		c.A = tc.a
+		c.P = tc.p
+		c.Step()
+		if len(r.Wrote) == 0 || r.Wrote[len(r.Wrote)-1] != tc.wrote {
+			t.Errorf("%s: wrote %02X, want %02X", tc.name, r.Wrote, tc.wrote)
+		}
+		if c.A != tc.wantA || c.P != tc.wantP {
+			t.Errorf("%s: A=%02X P=%08b, want A=%02X P=%08b", tc.name, c.A, c.P, tc.wantA, tc.wantP)
+		}
+	}
+}
+
+func TestPageCross(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   []byte
+		x, y   byte
+		cycles int
+	}{
+		{"LDA abs,X", []byte{0xbd, 0xff, 0x12}, 0, 0, 4},
+		{"LDA abs,X cross", []byte{0xbd, 0xff, 0x12}, 1, 0, 5},
+		{"LDA abs,Y", []byte{0xb9, 0xfe, 0x12}, 0, 1, 4},
+		{"LDA abs,Y cross", []byte{0xb9, 0xfe, 0x12}, 0, 2, 5},
+		{"LDX abs,Y cross", []byte{0xbe, 0xff, 0x12}, 0, 1, 5},
+		{"EOR abs,X cross", []byte{0x5d, 0x80, 0x12}, 0x80, 0, 5},
+		{"LDA (zp),Y", []byte{0xb1, 0x10}, 0, 0, 5},
+		{"LDA (zp),Y cross", []byte{0xb1, 0x10}, 0, 1, 6},
+		{"STA abs,X", []byte{0x9d, 0x00, 0x12}, 0, 0, 5},
+		{"STA abs,X cross", []byte{0x9d, 0xff, 0x12}, 1, 0, 5},
+		{"STA (zp),Y cross", []byte{0x91, 0x10}, 0, 1, 6},
+		{"INC abs,X cross", []byte{0xfe, 0xff, 0x12}, 1, 0, 7},
+	}
+	for _, tc := range tests {
+		c, r := NewWithRAM(tc.code, 0x0600)
+		r[0x10], r[0x11] = 0xff, 0x12 // ($10) = $12FF
+		c.X, c.Y = tc.x, tc.y
+		c.Step()
+		if c.stepCycles != tc.cycles {
+			t.Errorf("%s: %d cycles, want %d", tc.name, c.stepCycles, tc.cycles)
+		}
+	}
+}
+
+func TestBranchCycles(t *testing.T) {
+	tests := []struct {
+		name   string
+		pc     uint16
+		code   []byte
+		z      bool
+		cycles int
+		to     uint16
+	}{
+		{"not taken", 0x06f0, []byte{0xf0, 0x10}, false, 2, 0x06f2},
+		{"taken", 0x0600, []byte{0xf0, 0x10}, true, 3, 0x0612},
+		{"taken forward cross", 0x06f0, []byte{0xf0, 0x10}, true, 4, 0x0702},
+		{"taken backward cross", 0x0700, []byte{0xf0, 0xf0}, true, 4, 0x06f2},
+		{"taken to page end", 0x06fc, []byte{0xf0, 0x01}, true, 3, 0x06ff},
+	}
+	for _, tc := range tests {
+		c, _ := NewWithRAM(tc.code, tc.pc)
+		if tc.z {
+			c.P |= P_Z
+		}
+		c.Step()
+		if c.stepCycles != tc.cycles || c.PC != tc.to {
+			t.Errorf("%s: %d cycles to %04X, want %d to %04X", tc.name, c.stepCycles, c.PC, tc.cycles, tc.to)
+		}
+	}
+}
+
+func TestStepCycles(t *testing.T) {
+	c, r := NewWithRAM([]byte{
+		0xa9, 0x01, // LDA #$01: 2
+		0x8d, 0x00, 0x02, // STA $0200: 4
+		0xee, 0x00, 0x02, // INC $0200: 6
+		0xbd, 0xff, 0x02, // LDA $02FF,X: 4 + 1 with X=1
+		0x20, 0x00, 0x07, // JSR $0700: 6
+	}, 0x0600)
+	r[0x0700] = 0x60 // RTS: 6
+	c.X = 1
+	for i, want := range []int{2, 4, 6, 5, 6, 6} {
+		if got := c.Step(); got != want {
+			t.Errorf("instruction %d: %d cycles, want %d", i, got, want)
+		}
+	}
+}
+
+func TestHalt(t *testing.T) {
+	// LDA #$01; JMP $0602
+	c, r := NewWithRAM([]byte{0xa9, 0x01, 0x4c, 0x02, 0x06}, 0x0600)
+	c.Step()
+	if c.Halt {
+		t.Fatal("halted early")
+	}
+	c.Step()
+	if !c.Halt || c.PC != 0x0602 {
+		t.Fatalf("Halt = %v at %04X", c.Halt, c.PC)
+	}
+	r[RESET], r[RESET+1] = 0x00, 0x06
+	c.Reset()
+	if c.Halt || c.PC != 0x0600 {
+		t.Fatalf("Halt = %v at %04X after reset", c.Halt, c.PC)
+	}
+}
+
+func TestNMI(t *testing.T) {
+	c, r := NewWithRAM(nil, 0x0634)
+	r[IRQ], r[IRQ+1] = 0x00, 0x80
+	r[NMI], r[NMI+1] = 0x00, 0x90
+	c.P = P_X | P_I | P_C
+	c.S = 0xff
+	c.NMI()
+	if c.PC != 0x9000 {
+		t.Fatalf("PC = %04X, want 9000", c.PC)
+	}
+	if c.stepCycles != 7 {
+		t.Fatalf("got %d cycles, want 7", c.stepCycles)
+	}
+	if c.S != 0xfc || r[0x1ff] != 0x06 || r[0x1fe] != 0x34 {
+		t.Fatalf("bad stack: S = %02X, %02X %02X", c.S, r[0x1ff], r[0x1fe])
+	}
+	if p := r[0x1fd]; p&P_B != 0 || p&P_C == 0 {
+		t.Fatalf("pushed P = %08b", p)
+	}
+	c.CLI()
+	c.Interrupt()
+	if c.PC != 0x8000 {
+		t.Fatalf("PC = %04X, want 8000", c.PC)
+	}
+}
+
+func TestIRQ(t *testing.T) {
+	c, r := NewWithRAM(nil, 0x0634)
+	r[IRQ], r[IRQ+1] = 0x00, 0x80
+	c.S = 0xff
+	c.SEI()
+	if c.IRQ() {
+		t.Fatal("IRQ taken with I set")
+	}
+	if c.PC != 0x0634 || c.S != 0xff || c.stepCycles != 0 {
+		t.Fatalf("PC = %04X, S = %02X, %d cycles", c.PC, c.S, c.stepCycles)
+	}
+	c.CLI()
+	if !c.IRQ() {
+		t.Fatal("IRQ not taken with I clear")
+	}
+	if c.PC != 0x8000 || c.S != 0xfc || !c.I() || c.stepCycles != 7 {
+		t.Fatalf("PC = %04X, S = %02X, I = %v, %d cycles", c.PC, c.S, c.I(), c.stepCycles)
+	}
+	if r[0x1fd]&P_B != 0 {
+		t.Fatalf("pushed P = %08b", r[0x1fd])
+	}
+}
+
+func TestReset(t *testing.T) {
+	c, r := NewWithRAM(nil, 0x0000)
+	r[RESET], r[RESET+1] = 0x00, 0xc0
+	c.S = 0
+	c.P = P_X
+	c.Reset()
+	if c.S != 0xfd {
+		t.Fatalf("S = %02X, want FD", c.S)
+	}
+	if c.P != P_X|P_I {
+		t.Fatalf("P = %08b, want %08b", c.P, P_X|P_I)
+	}
+	if c.PC != 0xc000 || c.stepCycles != 7 {
+		t.Fatalf("PC = %04X, %d cycles", c.PC, c.stepCycles)
+	}
+	if r[0x100] != 0 || r[0x1ff] != 0 || r[0x1fe] != 0 {
+		t.Fatal("reset wrote to the stack")
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	program := []byte{
+		0xa2, 0x05, // LDX #$05
+		0x18,       // CLC
+		0x69, 0x03, // ADC #$03
+		0xca,       // DEX
+		0xd0, 0xfa, // BNE -6
+		0x4c, 0x08, 0x06, // JMP $0608
+	}
+	c, r := NewWithRAM(program, 0x0600)
+	c.TimingOverride = map[byte]int{0x18: 3}
+	for i := 0; i < 5; i++ {
+		c.Step()
+	}
+	c.OpenBus = 0x5a
+	state, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func() []Register {
+		var rs []Register
+		for !c.Halt {
+			c.Step()
+			rs = append(rs, c.Register)
+		}
+		return rs
+	}
+	want := run()
+	wantCycles := c.Cycles
+	if c.A != 15 {
+		t.Fatalf("A = %d, want 15", c.A)
+	}
+
+	d := New(r)
+	if err := d.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	if d.OpenBus != 0x5a {
+		t.Fatalf("OpenBus = %02X, want 5A", d.OpenBus)
+	}
+	c = d
+	got := run()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if c.TimingOverride[0x18] != 3 {
+		t.Fatal("TimingOverride not restored")
+	}
+	if c.Cycles != wantCycles {
+		t.Fatalf("Cycles = %d, want %d", c.Cycles, wantCycles)
+	}
+
+	if err := d.UnmarshalBinary(state[:10]); err == nil {
+		t.Fatal("expected error on short state")
+	}
+	state[0] = 0xff
+	if err := d.UnmarshalBinary(state); err == nil {
+		t.Fatal("expected error on unknown version")
+	}
+
+	// A 65C02 state restores its instruction set.
+	r = make(Ram, 0x10000)
+	r[0x0600] = 0x1a // INC A
+	c = NewVariant(r, CMOS65C02)
+	c.PC = 0x0600
+	if state, err = c.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	}
+	d = New(r)
+	if err := d.UnmarshalBinary(state); err != nil {
+		t.Fatal(err)
+	}
+	if d.Variant != CMOS65C02 || !d.FixIndirectJMP {
+		t.Fatalf("Variant = %v, FixIndirectJMP = %v", d.Variant, d.FixIndirectJMP)
+	}
+	if d.Step(); d.A != 1 {
+		t.Fatalf("A = %d after INC A, want 1", d.A)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0xa9, 0x01, // LDA #$01
+		0x85, 0x10, // STA $10
+		0xb5, 0x10, // LDA $10,X
+		0xb6, 0x10, // LDX $10,Y
+		0x8d, 0x00, 0x02, // STA $0200
+		0xbd, 0x00, 0x02, // LDA $0200,X
+		0xb9, 0x00, 0x02, // LDA $0200,Y
+		0x6c, 0xfc, 0xff, // JMP ($FFFC)
+		0xa1, 0x20, // LDA ($20,X)
+		0xb1, 0x20, // LDA ($20),Y
+		0xe8,       // INX
+		0xd0, 0xfe, // BNE $FE
+	})
+	want := []string{
+		"LDA #$01",
+		"STA $10",
+		"LDA $10,X",
+		"LDX $10,Y",
+		"STA $0200",
+		"LDA $0200,X",
+		"LDA $0200,Y",
+		"JMP ($FFFC)",
+		"LDA ($20,X)",
+		"LDA ($20),Y",
+		"INX",
+		"BNE $FE",
+	}
+	pc := uint16(0x0600)
+	for _, w := range want {
+		text, next := Disassemble(r, pc)
+		if text != w {
+			t.Errorf("%04X: got %q, want %q", pc, text, w)
+		}
+		pc = next
+	}
+	if pc != 0x061b {
+		t.Fatalf("ended at %04X, want 061B", pc)
+	}
+}
+
+func TestDisassembleRange(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0x20, 0x10, 0x06, // JSR $0610
+		0xca,       // DEX
+		0xd0, 0xfa, // BNE $FA
+		0x4c, 0x00, 0x07, // JMP $0700
+		0xad, 0x00, 0x02, // LDA $0200
+	})
+	sym := map[uint16]string{
+		0x0610: "init",
+		0x0600: "loop",
+		0x0200: "data",
+	}
+	got := DisassembleRange(r, 0x0600, 0x060a, sym)
+	want := []string{
+		"0600: JSR init",
+		"0603: DEX",
+		"0604: BNE loop",
+		"0606: JMP $0700",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestDisassembleVariant(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0x57, 0x10, // RMB5 $10
+		0x5f, 0x10, 0xfb, // BBR5 $10,$FB
+		0x80, 0xfe, // BRA $FE
+	})
+	got := NewVariant(r, WDC65C02).DisassembleRange(0x0600, 0x0606, nil)
+	want := []string{
+		"0600: RMB5 $10",
+		"0602: BBR5 $10,$FB",
+		"0605: BRA $FE",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// The NMOS table decodes the same bytes as other instructions.
+	if text, _ := New(r).Disassemble(0x0600); text == "RMB5 $10" {
+		t.Fatalf("NMOS disassembled %q", text)
+	}
+}
+
+func TestBRK(t *testing.T) {
+	// BRK; .byte $ff; INX
+	c, r := NewWithRAM([]byte{0x00, 0xff, 0xe8}, 0x0600)
+	copy(r[0x8000:], []byte{0x40}) // RTI
+	r[IRQ], r[IRQ+1] = 0x00, 0x80
+	c.S = 0xff
+	c.Step()
+	if c.PC != 0x8000 {
+		t.Fatalf("PC = %04X, want 8000", c.PC)
+	}
+	if r[0x1ff] != 0x06 || r[0x1fe] != 0x02 {
+		t.Fatalf("pushed %02X%02X, want 0602", r[0x1ff], r[0x1fe])
+	}
+	if r[0x1fd]&P_B == 0 {
+		t.Fatalf("pushed P = %08b, want P_B set", r[0x1fd])
+	}
+	c.Step()
+	if c.PC != 0x0602 || c.S != 0xff {
+		t.Fatalf("PC = %04X, S = %02X after RTI", c.PC, c.S)
+	}
+	c.Step()
+	if c.X != 1 {
+		t.Fatalf("X = %d, want 1", c.X)
+	}
+}
+
+func TestRMWDummyWrite(t *testing.T) {
+	r := &registerRam{Ram: make(Ram, 0xffff+1), Val: 0x41}
+	copy(r.Ram[0x0600:], []byte{0xee, 0x10, 0x00}) // INC $0010
+	c := New(r)
+	c.PC = 0x0600
+	c.Step()
+	if want := []byte{0x41, 0x42}; !reflect.DeepEqual(r.Wrote, want) {
+		t.Fatalf("wrote %02X, want %02X", r.Wrote, want)
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	c, _ := NewWithRAM([]byte{
+		0xa2, 0x03, // LDX #$03
+		0xca,       // DEX
+		0xd0, 0xfd, // BNE -3
+		0xea, // NOP
+	}, 0x0600)
+	var loop, done int
+	c.SetBreakpoint(0x0602, func(c *Cpu) { loop++ })
+	c.SetBreakpoint(0x0605, func(c *Cpu) {
+		done++
+		c.Y = 0x42
+	})
+	for i := 0; i < 8; i++ {
+		c.Step()
+	}
+	if loop != 3 || done != 1 {
+		t.Fatalf("hits: loop %d, done %d; want 3, 1", loop, done)
+	}
+	if c.Y != 0x42 {
+		t.Fatal("breakpoint did not modify the CPU")
+	}
+	c.ClearBreakpoint(0x0602)
+	c.PC = 0x0602
+	c.Step()
+	if loop != 3 {
+		t.Fatal("cleared breakpoint fired")
+	}
+}
+
+func TestWatchWrite(t *testing.T) {
+	c, _ := NewWithRAM([]byte{
+		0xa9, 0x0f, // LDA #$0F
+		0x8d, 0x15, 0x40, // STA $4015
+		0x8d, 0x00, 0x40, // STA $4000
+		0xa9, 0x00, // LDA #$00
+		0x8d, 0x15, 0x40, // STA $4015
+	}, 0x0600)
+	var got []byte
+	c.WatchWrite = func(addr uint16, val byte) {
+		if addr == 0x4015 {
+			got = append(got, val)
+		}
+	}
+	var reads []uint16
+	c.WatchRead = func(addr uint16, val byte) { reads = append(reads, addr) }
+	for i := 0; i < 5; i++ {
+		c.Step()
+	}
+	if want := []byte{0x0f, 0x00}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("$4015 writes %02X, want %02X", got, want)
+	}
+	if len(reads) < 2 || reads[0] != 0x0600 || reads[1] != 0x0601 {
+		t.Fatalf("reads %04X", reads)
+	}
+	for _, a := range reads {
+		if a&0xff00 == 0x4000 {
+			t.Fatalf("store read $%04X", a)
+		}
+	}
+
+	// The target of a jump is only read to fetch the next opcode.
+	c, r := NewWithRAM([]byte{
+		0x4c, 0x00, 0x07, // JMP $0700
+	}, 0x0600)
+	copy(r[0x0700:], []byte{
+		0x20, 0x00, 0x08, // JSR $0800
+	})
+	r[0x0800] = 0xea // NOP
+	reads = nil
+	c.WatchRead = func(addr uint16, val byte) { reads = append(reads, addr) }
+	c.StepN(3)
+	n := 0
+	for _, a := range reads {
+		if a == 0x0700 || a == 0x0800 {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Fatalf("reads %04X", reads)
+	}
+}
+
+// openBusMem is RAM with nothing mapped at $5000-$5FFF.
+type openBusMem struct {
+	Ram
+	c *Cpu
+}
+
+func (m *openBusMem) Read(v uint16) byte {
+	if v&0xf000 == 0x5000 {
+		return m.c.OpenBus
+	}
+	return m.Ram.Read(v)
+}
+
+func TestOpenBus(t *testing.T) {
+	c, r := NewWithRAM([]byte{
+		0xad, 0x00, 0x50, // LDA $5000
+		0xa2, 0x7e, // LDX #$7E
+		0x8e, 0x00, 0x02, // STX $0200
+		0xae, 0x34, 0x52, // LDX $5234
+	}, 0x0600)
+	c.M = &openBusMem{r, c}
+	c.Step()
+	// The last value on the bus is the high byte of the operand.
+	if c.A != 0x50 {
+		t.Fatalf("A = %02X, want 50", c.A)
+	}
+	c.Step()
+	c.Step()
+	if c.OpenBus != 0x7e {
+		t.Fatalf("OpenBus = %02X after write, want 7E", c.OpenBus)
+	}
+	c.Step()
+	if c.X != 0x52 {
+		t.Fatalf("X = %02X, want 52", c.X)
+	}
+}
+
+func TestOps(t *testing.T) {
+	program := []byte{0xea} // NOP
+	a, _ := NewWithRAM(program, 0x0600)
+	b, _ := NewWithRAM(program, 0x0600)
+	b.Ops[0xea] = &Op{F: INX, Mode: MODE_SNGL, T: 2}
+	a.Step()
+	b.Step()
+	if a.X != 0 || b.X != 1 {
+		t.Fatalf("X = %d, %d; want 0, 1", a.X, b.X)
+	}
+	if Optable[0xea].String() != "NOP" {
+		t.Fatal("package Optable modified")
+	}
+}
+
+func TestTrace(t *testing.T) {
+	c, r := NewWithRAM([]byte{
+		0xa2, 0x02, // LDX #$02
+		0xca,       // DEX
+		0xd0, 0xfd, // BNE -3
+		0x58, // CLI
+	}, 0x0600)
+	r[IRQ], r[IRQ+1] = 0x00, 0x07
+	var pcs []uint16
+	var ops []string
+	c.Trace = func(pc uint16, op *Op) {
+		pcs = append(pcs, pc)
+		if op == nil {
+			ops = append(ops, "IRQ")
+		} else {
+			ops = append(ops, op.String())
+		}
+	}
+	for i := 0; i < 6; i++ {
+		c.Step()
+	}
+	c.IRQ()
+	wantPCs := []uint16{0x0600, 0x0602, 0x0603, 0x0602, 0x0603, 0x0605, 0x0606}
+	wantOps := []string{"LDX", "DEX", "BNE", "DEX", "BNE", "CLI", "IRQ"}
+	if !reflect.DeepEqual(pcs, wantPCs) {
+		t.Fatalf("got PCs %04X, want %04X", pcs, wantPCs)
+	}
+	if !reflect.DeepEqual(ops, wantOps) {
+		t.Fatalf("got %v, want %v", ops, wantOps)
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	c, r := NewWithRAM([]byte{
+		0x20, 0x00, 0x07, // JSR $0700
+		0xea, // NOP
+	}, 0x0600)
+	copy(r[0x0700:], []byte{
+		0xa9, 0x01, // LDA #$01: 2
+		0x60, // RTS: 6
+	})
+	cycles, err := c.RunUntil(0x0603, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cycles != 14 || c.A != 1 {
+		t.Fatalf("%d cycles, A = %d; want 14, 1", cycles, c.A)
+	}
+
+	c.PC = 0x0600
+	cycles, err = c.RunUntil(0x0603, 7)
+	if err != ErrMaxCycles {
+		t.Fatalf("got %v, want ErrMaxCycles", err)
+	}
+	if cycles < 7 {
+		t.Fatalf("stopped after %d cycles", cycles)
+	}
+
+	c.PC = 0x0600
+	r[0x0700] = 0x02 // JAM
+	if _, err = c.RunUntil(0x0603, 100); err != ErrHalted {
+		t.Fatalf("got %v, want ErrHalted", err)
+	}
+}
+
+func TestRunCycles(t *testing.T) {
+	c, _ := NewWithRAM([]byte{
+		0xee, 0x00, 0x02, // INC $0200: 6
+		0x4c, 0x00, 0x06, // JMP $0600: 3
+	}, 0x0600)
+	got := c.RunCycles(100)
+	if got < 100 || got >= 100+7 {
+		t.Fatalf("ran %d cycles", got)
+	}
+	if got != 105 {
+		t.Fatalf("ran %d cycles, want 105", got)
+	}
+}
+
+func TestStepN(t *testing.T) {
+	c, _ := NewWithRAM([]byte{
+		0xa9, 0x10, // LDA #$10
+		0xaa,             // TAX
+		0xc8,             // INY
+		0xc8,             // INY
+		0xe8,             // INX
+		0x4c, 0x06, 0x06, // JMP $0606
+		0xc8, // INY
+	}, 0x0600)
+	c.StepN(5)
+	if c.A != 0x10 || c.X != 0x11 || c.Y != 2 || c.PC != 0x0606 {
+		t.Fatalf("A=%02X X=%02X Y=%02X PC=%04X", c.A, c.X, c.Y, c.PC)
+	}
+	c.StepN(5)
+	if !c.Halt || c.PC != 0x0606 {
+		t.Fatalf("Halt = %v at %04X", c.Halt, c.PC)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	c, r := NewWithRAM([]byte{
+		0xa9, 0x01, // LDA #$01: 2
+		0x8d, 0x00, 0x02, // STA $0200: 4
+		0xee, 0x00, 0x02, // INC $0200: 6
+		0x20, 0x00, 0x07, // JSR $0700: 6
+		0x4c, 0x0b, 0x06, // JMP $060B: 3
+	}, 0x0600)
+	r[0x0700] = 0x60 // RTS: 6
+	r[RESET], r[RESET+1] = 0x00, 0x06
+	c.Cycles = 1000
+	c.Reset()
+	if c.Cycles != 7 {
+		t.Fatalf("Cycles = %d after reset, want 7", c.Cycles)
+	}
+	c.Run()
+	if c.Cycles != 7+2+4+6+6+6+3 {
+		t.Fatalf("Cycles = %d, want %d", c.Cycles, 7+2+4+6+6+6+3)
+	}
+	c.ResetCycles()
+	if c.Cycles != 0 {
+		t.Fatalf("Cycles = %d after ResetCycles", c.Cycles)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	program := []byte{
+		0xa2, 0x03, // LDX #$03
+		0xa9, 0x00, // LDA #$00
+		0xca,       // DEX
+		0xd0, 0xfd, // BNE -3
+		0xa5, 0x10, // LDA $10
+	}
+	c, _ := NewWithRAM(program, 0x0600)
+	c.StepN(8)
+	if len(c.CoverageReport()) != 0 {
+		t.Fatal("coverage recorded while disabled")
+	}
+
+	c, _ = NewWithRAM(program, 0x0600)
+	c.TrackCoverage = true
+	c.StepN(9)
+	want := map[string]uint64{"LDX": 1, "LDA": 2, "DEX": 3, "BNE": 3}
+	if got := c.CoverageReport(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if c.Coverage[0xa9] != 1 || c.Coverage[0xa5] != 1 {
+		t.Fatal("LDA opcodes not counted separately")
+	}
+}
+
+func TestProfile(t *testing.T) {
+	c, _ := NewWithRAM([]byte{
+		0xa2, 0x00, // LDX #$00
+		0xe8,       // INX
+		0xe0, 0x64, // CPX #$64
+		0xd0, 0xfb, // BNE -5
+		0x4c, 0x07, 0x06, // JMP $0607
+	}, 0x0600)
+	c.Profiling = true
+	c.Run()
+	p := c.Profile()
+	// 99 taken branches at 3 cycles and one not taken at 2.
+	if p["BNE"] != 99*3+2 || p["CPX"] != 100*2 || p["INX"] != 100*2 {
+		t.Fatalf("got %v", p)
+	}
+	for op, n := range p {
+		if op != "BNE" && n > p["BNE"] {
+			t.Fatalf("%s used more cycles than BNE: %v", op, p)
+		}
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	c, _ := NewWithRAM([]byte{0xa9, 0x80}, 0x0600) // LDA #$80
+	c.L = make([]Log, 1)
+	c.P = P_X | P_C | P_D
+	c.Step()
+	b, err := json.Marshal(c.L[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		PC       uint16
+		Opcode   byte
+		Mnemonic string
+		Operand  string
+		A, P     byte
+		Flags    map[string]bool
+		Cycles   int
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.PC != 0x0600 || got.Opcode != 0xa9 || got.Mnemonic != "LDA" || got.Operand != "#$80" || got.A != 0x80 || got.Cycles != 2 {
+		t.Fatalf("got %s", b)
+	}
+	flags := map[string]byte{"N": P_N, "V": P_V, "B": P_B, "D": P_D, "I": P_I, "Z": P_Z, "C": P_C}
+	for name, bit := range flags {
+		if want := got.P&bit != 0; got.Flags[name] != want {
+			t.Errorf("flag %s = %v, want %v (P = %08b)", name, got.Flags[name], want, got.P)
+		}
+	}
+}
+
+func TestTraceWriter(t *testing.T) {
+	c, _ := NewWithRAM([]byte{
+		0xa2, 0x03, // LDX #$03
+		0xca,       // DEX
+		0xd0, 0xfd, // BNE -3
+	}, 0x0600)
+	var buf bytes.Buffer
+	c.SetTraceWriter(&buf)
+	c.StepN(7)
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 7 {
+		t.Fatalf("got %d lines, want 7:\n%s", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[1], "0602: CA DEX") {
+		t.Fatalf("bad line: %q", lines[1])
+	}
+	c.SetTraceWriter(nil)
+	c.PC = 0x0600
+	c.Step()
+	if strings.Count(buf.String(), "\n") != 7 {
+		t.Fatal("wrote after clearing the writer")
+	}
+}
+
+func TestTRBTSB(t *testing.T) {
+	tests := []struct {
+		name     string
+		op       byte
+		a, m     byte
+		want     byte
+		wantZero bool
+	}{
+		{"trb1", 0x14, 0x0f, 0x3c, 0x30, false},
+		{"trb2", 0x14, 0x03, 0x3c, 0x3c, true},
+		{"tsb1", 0x04, 0x0f, 0x3c, 0x3f, false},
+		{"tsb2", 0x04, 0xc0, 0x3c, 0xfc, true},
+	}
+	for _, tc := range tests {
+		r := make(Ram, 0x10000)
+		copy(r[0x0600:], []byte{tc.op, 0x10})
+		r[0x10] = tc.m
+		c := NewVariant(r, CMOS65C02)
+		c.PC = 0x0600
+		c.A = tc.a
+		if n := c.Step(); n != 5 {
+			t.Errorf("%s: %d cycles, want 5", tc.name, n)
+		}
+		if r[0x10] != tc.want || c.Z() != tc.wantZero || c.A != tc.a {
+			t.Errorf("%s: got %02X Z=%v, want %02X Z=%v", tc.name, r[0x10], c.Z(), tc.want, tc.wantZero)
+		}
+	}
+
+	// On the NMOS 6502, $04 is a NOP.
+	c, r := NewWithRAM([]byte{0x04, 0x10}, 0x0600)
+	r[0x10] = 0x3c
+	c.A = 0x0f
+	c.Step()
+	if r[0x10] != 0x3c || c.PC != 0x0602 {
+		t.Fatalf("NMOS $04 wrote %02X", r[0x10])
+	}
+}
+
+func TestZeroPageIndirect(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{0xb2, 0xff}) // LDA ($FF)
+	r[0xff], r[0x00] = 0x34, 0x12
+	r[0x1234] = 0x99
+	c := NewVariant(r, CMOS65C02)
+	c.PC = 0x0600
+	if n := c.Step(); n != 5 {
+		t.Fatalf("%d cycles, want 5", n)
+	}
+	if c.A != 0x99 || c.PC != 0x0602 {
+		t.Fatalf("A = %02X, PC = %04X", c.A, c.PC)
+	}
+	if s := c.Ops[0xb2].Mode.Format(); s != "($%02[3]X)" {
+		t.Fatalf("format %q", s)
+	}
+
+	// STA ($FF) writes without reading its target.
+	copy(r[0x0602:], []byte{0x92, 0xff})
+	c.WatchRead = func(addr uint16, val byte) {
+		if addr == 0x1234 {
+			t.Fatal("STA read its target")
+		}
+	}
+	if c.Step(); r[0x1234] != 0x99 || c.PC != 0x0604 {
+		t.Fatalf("$1234 = %02X, PC = %04X", r[0x1234], c.PC)
+	}
+}
+
+func TestSTZ(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0x64, 0x10, // STZ $10
+		0x74, 0x10, // STZ $10,X
+		0x9c, 0x00, 0x02, // STZ $0200
+		0x9e, 0x00, 0x02, // STZ $0200,X
+	})
+	for _, a := range []uint16{0x10, 0x12, 0x0200, 0x0202} {
+		r[a] = 0xff
+	}
+	c := NewVariant(r, CMOS65C02)
+	c.PC = 0x0600
+	c.A = 0xff
+	c.X = 2
+	for i, want := range []int{3, 4, 4, 5} {
+		if n := c.Step(); n != want {
+			t.Errorf("instruction %d: %d cycles, want %d", i, n, want)
+		}
+	}
+	for _, a := range []uint16{0x10, 0x12, 0x0200, 0x0202} {
+		if r[a] != 0 {
+			t.Errorf("$%04X = %02X, want 0", a, r[a])
+		}
+	}
+}
+
+func TestBRA(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{0x80, 0x10}) // BRA +16
+	copy(r[0x0612:], []byte{0x80, 0xec}) // BRA -20
+	copy(r[0x06fc:], []byte{0x80, 0x02}) // BRA +2
+	c := NewVariant(r, CMOS65C02)
+	c.PC = 0x0600
+	if n := c.Step(); n != 3 || c.PC != 0x0612 {
+		t.Fatalf("forward: PC = %04X, %d cycles", c.PC, n)
+	}
+	if n := c.Step(); n != 3 || c.PC != 0x0600 {
+		t.Fatalf("backward: PC = %04X, %d cycles", c.PC, n)
+	}
+	c.PC = 0x06fc
+	if n := c.Step(); n != 4 || c.PC != 0x0700 {
+		t.Fatalf("page cross: PC = %04X, %d cycles", c.PC, n)
+	}
+}
+
+func TestPushPullXY(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0xda,       // PHX
+		0x5a,       // PHY
+		0xa2, 0x00, // LDX #$00
+		0xa0, 0x01, // LDY #$01
+		0x7a, // PLY
+		0xfa, // PLX
+	})
+	c := NewVariant(r, CMOS65C02)
+	c.PC = 0x0600
+	c.X = 0x80
+	c.Y = 0x00
+	c.StepN(4)
+	if c.X != 0 || c.Y != 1 {
+		t.Fatalf("X = %02X, Y = %02X before pulls", c.X, c.Y)
+	}
+	if n := c.Step(); n != 4 || c.Y != 0 || !c.Z() || c.N() {
+		t.Fatalf("PLY: Y = %02X, Z = %v, N = %v, %d cycles", c.Y, c.Z(), c.N(), n)
+	}
+	if n := c.Step(); n != 4 || c.X != 0x80 || c.Z() || !c.N() {
+		t.Fatalf("PLX: X = %02X, Z = %v, N = %v, %d cycles", c.X, c.Z(), c.N(), n)
+	}
+	if c.S != 0xfd {
+		t.Fatalf("S = %02X, want FD", c.S)
+	}
+}
+
+func TestIncDecA(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0x1a, // INC A
+		0x3a, // DEC A
+	})
+	c := NewVariant(r, CMOS65C02)
+	c.PC = 0x0600
+	c.A = 0xff
+	if n := c.Step(); n != 2 || c.A != 0 || !c.Z() || c.N() {
+		t.Fatalf("INC A: A = %02X, Z = %v, N = %v, %d cycles", c.A, c.Z(), c.N(), n)
+	}
+	if n := c.Step(); n != 2 || c.A != 0xff || c.Z() || !c.N() {
+		t.Fatalf("DEC A: A = %02X, Z = %v, N = %v, %d cycles", c.A, c.Z(), c.N(), n)
+	}
+}
+
+func TestRockwellBits(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0xd7, 0x10, // SMB5 $10
+		0xdf, 0x10, 0x02, // BBS5 $10,+2
+		0xea, 0xea, // NOP; NOP
+		0x57, 0x10, // RMB5 $10
+		0xdf, 0x10, 0x7f, // BBS5 $10,+127
+		0x5f, 0x10, 0x00, // BBR5 $10,+0
+	})
+	r[0x10] = 0x01
+	c := NewVariant(r, Rockwell65C02)
+	c.PC = 0x0600
+	if n := c.Step(); n != 5 || r[0x10] != 0x21 {
+		t.Fatalf("SMB5: $10 = %02X, %d cycles", r[0x10], n)
+	}
+	if n := c.Step(); n != 6 || c.PC != 0x0607 {
+		t.Fatalf("BBS5 taken: PC = %04X, %d cycles", c.PC, n)
+	}
+	if c.Step(); r[0x10] != 0x01 {
+		t.Fatalf("RMB5: $10 = %02X", r[0x10])
+	}
+	if n := c.Step(); n != 5 || c.PC != 0x060c {
+		t.Fatalf("BBS5 not taken: PC = %04X, %d cycles", c.PC, n)
+	}
+	if c.Step(); c.PC != 0x060f {
+		t.Fatalf("BBR5: PC = %04X", c.PC)
+	}
+
+	// On the plain 65C02, $D7 is a one byte NOP.
+	c = NewVariant(r, CMOS65C02)
+	c.PC = 0x0600
+	if c.Step(); c.PC != 0x0601 {
+		t.Fatalf("65C02 $D7: PC = %04X", c.PC)
+	}
+}
+
+func TestJMPIndexedIndirect(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{0x7c, 0xfc, 0x10}) // JMP ($10FC,X)
+	// A jump table straddling a page.
+	copy(r[0x10fc:], []byte{0x00, 0x20, 0x00, 0x30, 0x00, 0x40})
+	for x, want := range map[byte]uint16{0: 0x2000, 2: 0x3000, 4: 0x4000} {
+		c := NewVariant(r, CMOS65C02)
+		c.PC = 0x0600
+		c.X = x
+		if n := c.Step(); n != 6 || c.PC != want {
+			t.Errorf("X=%d: PC = %04X, %d cycles; want %04X", x, c.PC, n, want)
+		}
+	}
+}
+
+func TestFixIndirectJMP(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{0x6c, 0xff, 0x10}) // JMP ($10FF)
+	r[0x10ff] = 0x34
+	r[0x1000] = 0x12
+	r[0x1100] = 0x56
+	for _, tc := range []struct {
+		fix  bool
+		want uint16
+	}{
+		{false, 0x1234},
+		{true, 0x5634},
+	} {
+		c := New(r)
+		c.PC = 0x0600
+		c.FixIndirectJMP = tc.fix
+		c.Step()
+		if c.PC != tc.want {
+			t.Errorf("FixIndirectJMP = %v: PC = %04X, want %04X", tc.fix, c.PC, tc.want)
+		}
+	}
+	if !NewVariant(r, CMOS65C02).FixIndirectJMP || NewVariant(r, NMOS).FixIndirectJMP {
+		t.Fatal("bad variant default")
+	}
+}
+
+// unofficialImm runs the immediate instruction op with operand imm.
+func unofficialImm(op, imm, a, x, p byte) *Cpu {
+	c, _ := NewWithRAM([]byte{op, imm}, 0x0600)
+	c.A, c.X, c.P = a, x, p
+	c.Step()
+	return c
+}
+
+func TestANC(t *testing.T) {
+	for _, op := range []byte{0x0b, 0x2b} {
+		c := unofficialImm(op, 0xff, 0x80, 0, P_X)
+		if c.A != 0x80 || !c.C() || !c.N() || c.Z() {
+			t.Errorf("%02X: A = %02X, P = %08b", op, c.A, c.P)
+		}
+		c = unofficialImm(op, 0x7f, 0x80, 0, P_X|P_C)
+		if c.A != 0 || c.C() || c.N() || !c.Z() {
+			t.Errorf("%02X: A = %02X, P = %08b", op, c.A, c.P)
+		}
+	}
+}
+
+func TestALR(t *testing.T) {
+	// The AND clears bit 0 of A, so C comes from the ANDed value.
+	c := unofficialImm(0x4b, 0xfe, 0x03, 0, P_X)
+	if c.A != 0x01 || c.C() || c.Z() {
+		t.Errorf("A = %02X, P = %08b", c.A, c.P)
+	}
+	c = unofficialImm(0x4b, 0x81, 0x01, 0, P_X)
+	if c.A != 0 || !c.C() || !c.Z() || c.N() {
+		t.Errorf("A = %02X, P = %08b", c.A, c.P)
+	}
+}
+
+func TestARR(t *testing.T) {
+	tests := []struct {
+		name    string
+		imm, a  byte
+		p       byte
+		wantA   byte
+		c, v, n bool
+	}{
+		// Binary: C is bit 6 and V is bit 6 xor bit 5 of the result.
+		{"binary", 0xff, 0xc0, P_X, 0x60, true, false, false},
+		{"binary V", 0xff, 0x80, P_X, 0x40, true, true, false},
+		{"binary carry in", 0xff, 0x40, P_X | P_C, 0xa0, false, true, true},
+		// Decimal: the nibbles of the rotated value are adjusted.
+		{"decimal", 0xff, 0xff, P_X | P_D, 0xd5, true, false, false},
+		{"decimal carry in", 0xff, 0x22, P_X | P_D | P_C, 0x91, false, false, true},
+	}
+	for _, tc := range tests {
+		c := unofficialImm(0x6b, tc.imm, tc.a, 0, tc.p)
+		if c.A != tc.wantA || c.C() != tc.c || c.V() != tc.v || c.N() != tc.n {
+			t.Errorf("%s: A = %02X C=%v V=%v N=%v; want %02X C=%v V=%v N=%v", tc.name, c.A, c.C(), c.V(), c.N(), tc.wantA, tc.c, tc.v, tc.n)
+		}
+	}
+}
+
+func TestSBX(t *testing.T) {
+	c := unofficialImm(0xcb, 0x05, 0xff, 0x0f, P_X)
+	if c.X != 0x0a || !c.C() || c.Z() || c.N() || c.A != 0xff {
+		t.Errorf("X = %02X, A = %02X, P = %08b", c.X, c.A, c.P)
+	}
+	// The carry is not used as a borrow, and is cleared on underflow.
+	c = unofficialImm(0xcb, 0x10, 0xff, 0x0f, P_X|P_C)
+	if c.X != 0xff || c.C() || !c.N() {
+		t.Errorf("X = %02X, P = %08b", c.X, c.P)
+	}
+}
+
+func TestLAS(t *testing.T) {
+	c, r := NewWithRAM([]byte{
+		0xbb, 0x00, 0x02, // LAS $0200,Y
+		0xbb, 0xff, 0x02, // LAS $02FF,Y
+	}, 0x0600)
+	r[0x0201] = 0xb6
+	r[0x0300] = 0x0f
+	c.Y = 1
+	c.S = 0xf3
+	if n := c.Step(); n != 4 {
+		t.Fatalf("%d cycles, want 4", n)
+	}
+	if c.A != 0xb2 || c.X != 0xb2 || c.S != 0xb2 || !c.N() || c.Z() {
+		t.Fatalf("A=%02X X=%02X S=%02X P=%08b", c.A, c.X, c.S, c.P)
+	}
+	if n := c.Step(); n != 5 {
+		t.Fatalf("%d cycles with page cross, want 5", n)
+	}
+	if c.A != 0x02 || c.X != 0x02 || c.S != 0x02 || c.N() {
+		t.Fatalf("A=%02X X=%02X S=%02X P=%08b", c.A, c.X, c.S, c.P)
+	}
+}
+
+func TestStoreHigh(t *testing.T) {
+	// A=F5, and the unindexed address is in page $12 without a page cross,
+	// so the stored value is ANDed with $13.
+	tests := []struct {
+		name    string
+		program []byte
+		x, y    byte
+		addr    uint16
+		want    byte
+	}{
+		{"SHA abs,Y", []byte{0x9f, 0x00, 0x12}, 0x3c, 0x10, 0x1210, 0xf5 & 0x3c & 0x13},
+		{"SHA (zp),Y", []byte{0x93, 0x20}, 0x3c, 0x10, 0x1210, 0xf5 & 0x3c & 0x13},
+		{"SHX", []byte{0x9e, 0x00, 0x12}, 0x3c, 0x10, 0x1210, 0x3c & 0x13},
+		{"SHY", []byte{0x9c, 0x00, 0x12}, 0x10, 0xfe, 0x1210, 0xfe & 0x13},
+		{"TAS", []byte{0x9b, 0x00, 0x12}, 0x3c, 0x10, 0x1210, 0xf5 & 0x3c & 0x13},
+	}
+	for _, tc := range tests {
+		c, r := NewWithRAM(tc.program, 0x0600)
+		r[0x20], r[0x21] = 0x00, 0x12
+		c.A, c.X, c.Y = 0xf5, tc.x, tc.y
+		c.Step()
+		if r[tc.addr] != tc.want {
+			t.Errorf("%s: wrote %02X, want %02X", tc.name, r[tc.addr], tc.want)
+		}
+		if tc.name == "TAS" && c.S != 0xf5&0x3c {
+			t.Errorf("TAS: S = %02X, want %02X", c.S, 0xf5&0x3c)
+		}
+	}
+}
+
+func TestANE(t *testing.T) {
+	defer func(m byte) { XAAMagic = m }(XAAMagic)
+	XAAMagic = 0xff
+	c := unofficialImm(0x8b, 0xf0, 0x00, 0x3c, P_X)
+	if c.A != 0x30 || c.N() || c.Z() {
+		t.Errorf("A = %02X, P = %08b", c.A, c.P)
+	}
+	XAAMagic = 0x00
+	c = unofficialImm(0x8b, 0xff, 0x81, 0xf0, P_X)
+	if c.A != 0x80 || !c.N() {
+		t.Errorf("A = %02X, P = %08b", c.A, c.P)
+	}
+}
+
+func TestJAM(t *testing.T) {
+	c, _ := NewWithRAM([]byte{
+		0xe8, // INX
+		0x02, // JAM
+		0xe8, // INX
+	}, 0x0600)
+	var jammed []uint16
+	c.JamHook = func(pc uint16) { jammed = append(jammed, pc) }
+	c.Run()
+	if !c.Halt || c.PC != 0x0601 || c.X != 1 {
+		t.Fatalf("Halt = %v, PC = %04X, X = %d", c.Halt, c.PC, c.X)
+	}
+	if len(jammed) != 1 || jammed[0] != 0x0601 {
+		t.Fatalf("JamHook called with %04X", jammed)
+	}
+}
+
+func TestUnofficialNOP(t *testing.T) {
+	c, _ := NewWithRAM([]byte{
+		0x1c, 0x00, 0x02, // NOP $0200,X
+		0x1c, 0xff, 0x02, // NOP $02FF,X
+		0x04, 0x10, // NOP $10
+		0x14, 0x10, // NOP $10,X
+		0x0c, 0x00, 0x02, // NOP $0200
+		0x1a, // NOP
+	}, 0x0600)
+	c.X = 1
+	var reads []uint16
+	c.WatchRead = func(addr uint16, val byte) { reads = append(reads, addr) }
+	for i, want := range []int{4, 5, 3, 4, 4, 2} {
+		if n := c.Step(); n != want {
+			t.Errorf("instruction %d: %d cycles, want %d", i, n, want)
+		}
+	}
+	if reads[3] != 0x0201 || reads[7] != 0x0300 {
+		t.Fatalf("reads %04X", reads)
+	}
+}
+
+func TestWAI(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0xcb, // WAI
+		0xe8, // INX
+	})
+	r[NMI], r[NMI+1] = 0x00, 0x80
+	c := NewVariant(r, WDC65C02)
+	c.PC = 0x0600
+	if n := c.Step(); n != 3 || !c.Waiting {
+		t.Fatalf("WAI: Waiting = %v, %d cycles", c.Waiting, n)
+	}
+	for i := 0; i < 10; i++ {
+		if n := c.Step(); n != 1 {
+			t.Fatalf("%d cycles while waiting", n)
+		}
+	}
+	if c.PC != 0x0601 || c.X != 0 {
+		t.Fatalf("PC = %04X, X = %d while waiting", c.PC, c.X)
+	}
+	c.NMI()
+	if c.Waiting || c.PC != 0x8000 {
+		t.Fatalf("after NMI: Waiting = %v, PC = %04X", c.Waiting, c.PC)
+	}
+
+	// A masked IRQ resumes at the next instruction.
+	c.PC = 0x0600
+	c.SEI()
+	c.Step()
+	c.IRQ()
+	c.Step()
+	if c.Waiting || c.X != 1 {
+		t.Fatalf("after IRQ: Waiting = %v, X = %d", c.Waiting, c.X)
+	}
+
+	// On the NMOS 6502, $CB is SBX.
+	c = unofficialImm(0xcb, 0x00, 0xff, 0x01, P_X)
+	if c.Waiting || c.PC != 0x0602 {
+		t.Fatal("NMOS $CB waited")
+	}
+}
+
+func TestSTP(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0xe8, // INX
+		0xdb, // STP
+		0xe8, // INX
+	})
+	r[RESET], r[RESET+1] = 0x02, 0x06
+	c := NewVariant(r, WDC65C02)
+	c.PC = 0x0600
+	c.Run()
+	if !c.Halt || c.PC != 0x0601 || c.X != 1 {
+		t.Fatalf("Halt = %v, PC = %04X, X = %d", c.Halt, c.PC, c.X)
+	}
+	c.Reset()
+	if c.Halt {
+		t.Fatal("Halt set after Reset")
+	}
+	c.Step()
+	if c.X != 2 {
+		t.Fatalf("X = %d after reset, want 2", c.X)
+	}
+}
+
+func TestBIT65C02(t *testing.T) {
+	r := make(Ram, 0x10000)
+	copy(r[0x0600:], []byte{
+		0x89, 0x00, // BIT #$00
+		0x34, 0x10, // BIT $10,X
+		0x3c, 0xff, 0x01, // BIT $01FF,X
+	})
+	r[0x11] = 0xc1
+	r[0x0200] = 0x40
+	c := NewVariant(r, CMOS65C02)
+	c.PC = 0x0600
+	c.A = 0x01
+	c.X = 1
+	c.P = P_X | P_N | P_V
+	if n := c.Step(); n != 2 || !c.Z() || !c.N() || !c.V() {
+		t.Fatalf("BIT #$00: P = %08b, %d cycles", c.P, n)
+	}
+	c.P = P_X
+	if n := c.Step(); n != 4 || c.Z() || !c.N() || !c.V() {
+		t.Fatalf("BIT $10,X: P = %08b, %d cycles", c.P, n)
+	}
+	if n := c.Step(); n != 5 || !c.Z() || c.N() || !c.V() {
+		t.Fatalf("BIT $01FF,X: P = %08b, %d cycles", c.P, n)
+	}
+}
+
+func TestVariant(t *testing.T) {
+	tests := []struct {
+		op   byte
+		want [4]string // NMOS, 65C02, Rockwell, WDC
+	}{
+		{0x07, [4]string{"SLO", "NOP", "RMB0", "RMB0"}},
+		{0x80, [4]string{"NOP", "BRA", "BRA", "BRA"}},
+		{0xcb, [4]string{"SBX", "NOP", "NOP", "WAI"}},
+		{0xdb, [4]string{"DCP", "NOP", "NOP", "STP"}},
+		{0x02, [4]string{"JAM", "NOP", "NOP", "NOP"}},
+		{0xa9, [4]string{"LDA", "LDA", "LDA", "LDA"}},
+	}
+	variants := []Variant{NMOS, CMOS65C02, Rockwell65C02, WDC65C02}
+	for i, v := range variants {
+		c := NewVariant(make(Ram, 0x10000), v)
+		if c.Variant != v {
+			t.Fatalf("%v: Variant = %v", v, c.Variant)
+		}
+		for _, tc := range tests {
+			if got := c.Ops[tc.op].String(); got != tc.want[i] {
+				t.Errorf("%v: %02X is %s, want %s", v, tc.op, got, tc.want[i])
+			}
+		}
+	}
+	if s := WDC65C02.String(); s != "WDC 65C02" {
+		t.Fatalf("String() = %q", s)
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []byte
+	}{
+		{"LDA #$01", []byte{0xa9, 0x01}},
+		{"sta $10", []byte{0x85, 0x10}},
+		{"LDA $10,X", []byte{0xb5, 0x10}},
+		{"LDX $10,Y", []byte{0xb6, 0x10}},
+		{"STA $0200", []byte{0x8d, 0x00, 0x02}},
+		{"STA $0010", []byte{0x8d, 0x10, 0x00}},
+		{"LDA $0200,X", []byte{0xbd, 0x00, 0x02}},
+		{"LDA $10,Y", []byte{0xb9, 0x10, 0x00}},
+		{"JMP ($FFFC)", []byte{0x6c, 0xfc, 0xff}},
+		{"LDA ($20,X)", []byte{0xa1, 0x20}},
+		{"LDA ($20),Y", []byte{0xb1, 0x20}},
+		{"INX", []byte{0xe8}},
+		{"ASL A", []byte{0x0a}},
+		{"BNE $FE", []byte{0xd0, 0xfe}},
+		{"JSR $1234", []byte{0x20, 0x34, 0x12}},
+		{"BRK", []byte{0x00}},
+		{"LDA #10 ; decimal\n\nRTS", []byte{0xa9, 0x0a, 0x60}},
+	}
+	for _, tc := range tests {
+		got, err := Assemble(tc.src)
+		if err != nil {
+			t.Errorf("%q: %v", tc.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got % X, want % X", tc.src, got, tc.want)
+		}
+	}
+	for _, src := range []string{"FOO", "LDA", "LDA #$100", "STA #$01", "LDA ($1234,X)", "LDA $10,Z", "JMP $10 $20"} {
+		if _, err := Assemble(src); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestAssembleDisassemble(t *testing.T) {
+	r := make(Ram, 0x10000)
+	for _, i := range Opcodes {
+		for m := MODE_IMM; m <= MODE_BRA; m++ {
+			code, ok := i.code(m)
+			if !ok {
+				continue
+			}
+			r[0], r[1], r[2] = code, 0x12, 0x34
+			text, _ := Disassemble(r, 0)
+			b, err := Assemble(text)
+			if err != nil {
+				t.Errorf("%q: %v", text, err)
+			} else if b[0] != code {
+				t.Errorf("%q: assembled %02X, want %02X", text, b[0], code)
+			}
+		}
+	}
+}
+
+func TestEffectiveAddr(t *testing.T) {
+	r := make(Ram, 0x10000)
+	r[0x20], r[0x21] = 0x00, 0x30 // ($20)
+	r[0xff], r[0x00] = 0xf0, 0x40 // ($FF) wraps to $00
+	r[0x10ff], r[0x1000] = 0x34, 0x12
+	tests := []struct {
+		name    string
+		m       Mode
+		operand []byte
+		x, y    byte
+		addr    uint16
+		crossed bool
+	}{
+		{"IMM", MODE_IMM, []byte{0x12}, 0, 0, 0x0601, false},
+		{"ZP", MODE_ZP, []byte{0x12}, 0, 0, 0x0012, false},
+		{"ZPX wrap", MODE_ZPX, []byte{0xf0}, 0x20, 0, 0x0010, false},
+		{"ZPY", MODE_ZPY, []byte{0x10}, 0, 0x05, 0x0015, false},
+		{"ABS", MODE_ABS, []byte{0x34, 0x12}, 0, 0, 0x1234, false},
+		{"ABSX", MODE_ABSX, []byte{0x00, 0x12}, 0x10, 0, 0x1210, false},
+		{"ABSX cross", MODE_ABSX, []byte{0xf0, 0x12}, 0x10, 0, 0x1300, true},
+		{"ABSY cross", MODE_ABSY, []byte{0xff, 0x12}, 0, 0x01, 0x1300, true},
+		{"IND wrap", MODE_IND, []byte{0xff, 0x10}, 0, 0, 0x1234, false},
+		{"INDX", MODE_INDX, []byte{0x10}, 0x10, 0, 0x3000, false},
+		{"INDX wrap", MODE_INDX, []byte{0xf0}, 0x0f, 0, 0x40f0, false},
+		{"INDY", MODE_INDY, []byte{0x20}, 0, 0x10, 0x3010, false},
+		{"INDY wrap cross", MODE_INDY, []byte{0xff}, 0, 0x10, 0x4100, true},
+		{"BRA", MODE_BRA, []byte{0xfc}, 0, 0, 0x05fe, true},
+		{"SNGL", MODE_SNGL, nil, 0, 0, 0, false},
+	}
+	for _, tc := range tests {
+		copy(r[0x0601:], tc.operand)
+		c := New(r)
+		c.PC = 0x0600
+		c.X, c.Y = tc.x, tc.y
+		addr, crossed := c.EffectiveAddr(tc.m)
+		if addr != tc.addr || crossed != tc.crossed {
+			t.Errorf("%s: got %04X %v, want %04X %v", tc.name, addr, crossed, tc.addr, tc.crossed)
+		}
+		if c.PC != 0x0600 {
+			t.Errorf("%s: PC modified", tc.name)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		op, a, b   byte
+		carry      bool
+		want       byte
+		n, v, z, c bool
+	}{
+		// ADC: Z is from the binary sum, N and V from the sum before the
+		// high digit is adjusted.
+		{0x69, 0x05, 0x05, false, 0x10, false, false, false, false},
+		{0x69, 0x99, 0x01, false, 0x00, true, false, false, true},
+		{0x69, 0x79, 0x00, true, 0x80, true, true, false, false},
+		{0x69, 0x24, 0x56, false, 0x80, true, true, false, false},
+		{0x69, 0x50, 0x50, false, 0x00, true, true, false, true},
+		{0x69, 0x80, 0x80, false, 0x60, false, true, true, true},
+		// SBC: all flags are from the binary difference.
+		{0xe9, 0x46, 0x12, true, 0x34, false, false, false, true},
+		{0xe9, 0x40, 0x13, true, 0x27, false, false, false, true},
+		{0xe9, 0x10, 0x01, true, 0x09, false, false, false, true},
+		{0xe9, 0x00, 0x01, true, 0x99, true, false, false, false},
+		{0xe9, 0x80, 0x01, true, 0x79, false, true, false, true},
+		{0xe9, 0x21, 0x34, false, 0x86, true, false, false, false},
+	}
+	for _, tc := range tests {
+		p := byte(P_X | P_D)
+		if tc.carry {
+			p |= P_C
+		}
+		c := unofficialImm(tc.op, tc.b, tc.a, 0, p)
+		if c.A != tc.want || c.N() != tc.n || c.V() != tc.v || c.Z() != tc.z || c.C() != tc.c {
+			t.Errorf("%02X %02X %02X C=%v: A = %02X N=%v V=%v Z=%v C=%v; want %02X N=%v V=%v Z=%v C=%v",
+				tc.op, tc.a, tc.b, tc.carry, c.A, c.N(), c.V(), c.Z(), c.C(), tc.want, tc.n, tc.v, tc.z, tc.c)
+		}
+	}
 }
@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) 2014 Maddy Blue <github@maddy.blue>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cpu6502
+
+import "fmt"
+
+// Variant selects the instruction set of a Cpu.
+type Variant int
+
+const (
+	// NMOS is the original 6502, including its unofficial opcodes.
+	NMOS Variant = iota
+	// CMOS65C02 is the 65C02, whose unused opcodes are all NOPs.
+	CMOS65C02
+	// Rockwell65C02 is the 65C02 with the Rockwell bit instructions
+	// RMB, SMB, BBR, and BBS.
+	Rockwell65C02
+	// WDC65C02 is the WDC 65C02, which adds WAI and STP to the Rockwell
+	// instructions.
+	WDC65C02
+)
+
+func (v Variant) String() string {
+	switch v {
+	case NMOS:
+		return "NMOS"
+	case CMOS65C02:
+		return "65C02"
+	case Rockwell65C02:
+		return "Rockwell 65C02"
+	case WDC65C02:
+		return "WDC 65C02"
+	}
+	return fmt.Sprintf("Variant(%d)", int(v))
+}
+
+// Opcode tables of the CMOS variants.
+var optable65C02, optableRockwell, optableWDC OpTable
+
+func init() {
+	optable65C02 = newOpTable(cmosNOP, Opcodes, CMOSOpcodes)
+	for code, f := range map[byte]Func{
+		0x12: ORA,
+		0x32: AND,
+		0x52: EOR,
+		0x72: ADC,
+		0x92: STA,
+		0xb2: LDA,
+		0xd2: CMP,
+		0xf2: SBC,
+	} {
+		optable65C02[code] = &Op{F: f, Mode: MODE_ZPIND, T: 5, NoRead: noRead[funcName(f)]}
+	}
+	optable65C02[0x7c] = &Op{F: JMP, Mode: MODE_ABSXIND, T: 6}
+
+	optableRockwell = optable65C02
+	for i, f := range []Func{RMB0, RMB1, RMB2, RMB3, RMB4, RMB5, RMB6, RMB7, SMB0, SMB1, SMB2, SMB3, SMB4, SMB5, SMB6, SMB7} {
+		optableRockwell[i<<4|0x07] = &Op{F: f, Mode: MODE_ZP, T: 5}
+	}
+	for i, f := range []Func{BBR0, BBR1, BBR2, BBR3, BBR4, BBR5, BBR6, BBR7, BBS0, BBS1, BBS2, BBS3, BBS4, BBS5, BBS6, BBS7} {
+		optableRockwell[i<<4|0x0f] = &Op{F: f, Mode: MODE_ZPREL, T: 5}
+	}
+
+	optableWDC = optableRockwell
+	optableWDC[0xcb] = &Op{F: WAI, Mode: MODE_SNGL, T: 3}
+	optableWDC[0xdb] = &Op{F: STP, Mode: MODE_SNGL, T: 3}
+}
+
+// NewVariant returns a Cpu with the instruction set of v. Its timings are
+// those of the NMOS 6502. New is equivalent to NewVariant with NMOS.
+func NewVariant(m Memory, v Variant) *Cpu {
+	c := New(m)
+	c.setVariant(v)
+	c.FixIndirectJMP = v != NMOS
+	return c
+}
+
+// setVariant sets Variant to v and Ops to a copy of its opcode table.
+func (c *Cpu) setVariant(v Variant) {
+	var ops OpTable
+	switch v {
+	case CMOS65C02:
+		ops = optable65C02
+	case Rockwell65C02:
+		ops = optableRockwell
+	case WDC65C02:
+		ops = optableWDC
+	default:
+		ops = Optable
+	}
+	c.Variant = v
+	c.Ops = &ops
+}
+
+// CMOSOpcodes are the instructions added by the 65C02 that use the NMOS
+// addressing modes.
+var CMOSOpcodes = []Instruction{
+	/* F,  Imm,   ZP,  ZPX,  ZPY,  ABS, ABSX, ABSY,  IND, INDX, INDY, SNGL,  BRA, TIM */
+	{TRB, null, 0x14, null, null, 0x1c, null, null, null, null, null, null, null, _2},
+	{TSB, null, 0x04, null, null, 0x0c, null, null, null, null, null, null, null, _2},
+	{BIT, 0x89, null, 0x34, null, null, 0x3c, null, null, null, null, null, null, _1},
+	{BRA, null, null, null, null, null, null, null, null, null, null, null, 0x80, _2},
+	{INC, null, null, null, null, null, null, null, null, null, null, 0x1a, null, _2},
+	{DEC, null, null, null, null, null, null, null, null, null, null, 0x3a, null, _2},
+	{PHX, null, null, null, null, null, null, null, null, null, null, 0xda, null, _3},
+	{PHY, null, null, null, null, null, null, null, null, null, null, 0x5a, null, _3},
+	{PLX, null, null, null, null, null, null, null, null, null, null, 0xfa, null, _S4},
+	{PLY, null, null, null, null, null, null, null, null, null, null, 0x7a, null, _S4},
+	{STZ, null, 0x64, 0x74, null, 0x9c, 0x9e, null, null, null, null, null, null, _3},
+}
+
+// NOPs for the empty slots of the 65C02 table.
+var (
+	cSN1 = &Op{F: NOP, Mode: MODE_SNGL, T: 1}
+	cIM2 = &Op{F: NOP, Mode: MODE_IMM, T: 2}
+	cZP3 = &Op{F: NOP, Mode: MODE_ZP, T: 3}
+	cZX4 = &Op{F: NOP, Mode: MODE_ZPX, T: 4}
+	cAB4 = &Op{F: NOP, Mode: MODE_ABS, T: 4}
+	cAB8 = &Op{F: NOP, Mode: MODE_ABS, T: 8}
+)
+
+// cmosNOP returns the NOP used for the unassigned 65C02 opcode i.
+func cmosNOP(i int) *Op {
+	switch {
+	case i&0x03 == 0x03:
+		return cSN1
+	case i&0x1f == 0x02:
+		return cIM2
+	}
+	switch i {
+	case 0x44:
+		return cZP3
+	case 0x54, 0xd4, 0xf4:
+		return cZX4
+	case 0x5c:
+		return cAB8
+	case 0xdc, 0xfc:
+		return cAB4
+	}
+	// The (zp) instructions at $12-$F2 and JMP ($1234,X) at $7C reach
+	// here, and are replaced by init once the table is built.
+	return nmosNOP(i)
+}
+
+func TRB(c *Cpu, b byte, v uint16, m Mode) {
+	if c.A&b != 0 {
+		c.P &= ^P_Z
+	} else {
+		c.P |= P_Z
+	}
+	c.write(v, b&^c.A)
+}
+
+func TSB(c *Cpu, b byte, v uint16, m Mode) {
+	if c.A&b != 0 {
+		c.P &= ^P_Z
+	} else {
+		c.P |= P_Z
+	}
+	c.write(v, b|c.A)
+}
+
+func STZ(c *Cpu, b byte, v uint16, m Mode) {
+	c.write(v, 0)
+}
+
+func BRA(c *Cpu, b byte, v uint16, m Mode) {
+	c.jump(uint16(b))
+}
+
+func PHX(c *Cpu, b byte, v uint16, m Mode) {
+	c.stackPush(c.X)
+}
+
+func PHY(c *Cpu, b byte, v uint16, m Mode) {
+	c.stackPush(c.Y)
+}
+
+func PLX(c *Cpu, b byte, v uint16, m Mode) {
+	c.X = c.stackPop()
+	c.setNZ(c.X)
+}
+
+func PLY(c *Cpu, b byte, v uint16, m Mode) {
+	c.Y = c.stackPop()
+	c.setNZ(c.Y)
+}
+
+// The Rockwell bit instructions. RMBn and SMBn clear and set bit n of a
+// zero page byte. BBRn and BBSn branch if bit n of a zero page byte is
+// clear or set.
+
+func RMB0(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b&^0x01) }
+func RMB1(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b&^0x02) }
+func RMB2(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b&^0x04) }
+func RMB3(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b&^0x08) }
+func RMB4(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b&^0x10) }
+func RMB5(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b&^0x20) }
+func RMB6(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b&^0x40) }
+func RMB7(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b&^0x80) }
+
+func SMB0(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b|0x01) }
+func SMB1(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b|0x02) }
+func SMB2(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b|0x04) }
+func SMB3(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b|0x08) }
+func SMB4(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b|0x10) }
+func SMB5(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b|0x20) }
+func SMB6(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b|0x40) }
+func SMB7(c *Cpu, b byte, v uint16, m Mode) { c.write(v, b|0x80) }
+
+// For BBR and BBS, b is the zero page byte and v the branch offset.
+
+func BBR0(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x01 == 0, v) }
+func BBR1(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x02 == 0, v) }
+func BBR2(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x04 == 0, v) }
+func BBR3(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x08 == 0, v) }
+func BBR4(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x10 == 0, v) }
+func BBR5(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x20 == 0, v) }
+func BBR6(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x40 == 0, v) }
+func BBR7(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x80 == 0, v) }
+
+func BBS0(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x01 != 0, v) }
+func BBS1(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x02 != 0, v) }
+func BBS2(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x04 != 0, v) }
+func BBS3(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x08 != 0, v) }
+func BBS4(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x10 != 0, v) }
+func BBS5(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x20 != 0, v) }
+func BBS6(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x40 != 0, v) }
+func BBS7(c *Cpu, b byte, v uint16, m Mode) { c.branchBit(b&0x80 != 0, v) }
+
+func (c *Cpu) branchBit(taken bool, offset uint16) {
+	if taken {
+		c.jump(offset)
+	}
+}
+
+// WAI waits for an interrupt.
+func WAI(c *Cpu, b byte, v uint16, m Mode) {
+	c.Waiting = true
+}
+
+// STP stops the CPU until Reset. PC is left on the opcode, as for JAM.
+func STP(c *Cpu, b byte, v uint16, m Mode) {
+	c.PC--
+	c.Halt = true
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright (c) 2014 Maddy Blue <github@maddy.blue>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cpu6502
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// code returns the opcode of i in mode m, or false if it has none.
+func (i Instruction) code(m Mode) (byte, bool) {
+	var c byte
+	switch m {
+	case MODE_IMM:
+		c = i.Imm
+	case MODE_ZP:
+		c = i.ZP
+	case MODE_ZPX:
+		c = i.ZPX
+	case MODE_ZPY:
+		c = i.ZPY
+	case MODE_ABS:
+		c = i.ABS
+	case MODE_ABSX:
+		c = i.ABSX
+	case MODE_ABSY:
+		c = i.ABSY
+	case MODE_IND:
+		c = i.IND
+	case MODE_INDX:
+		c = i.INDX
+	case MODE_INDY:
+		c = i.INDY
+	case MODE_SNGL:
+		c = i.SNGL
+	case MODE_BRA:
+		c = i.BRA
+	}
+	return c, c != null
+}
+
+// Assemble assembles src, which has one instruction per line, into
+// machine code for the documented NMOS opcodes. Operands use the syntax
+// of Disassemble: #$12, $12, $1234, $12,X, $1234,Y, ($1234), ($12,X), and
+// ($12),Y. A two digit address selects zero page when the instruction
+// has that mode. Branch operands are the offset byte. Text following a
+// semicolon is ignored. Labels are not supported.
+func Assemble(src string) ([]byte, error) {
+	var out []byte
+	for n, line := range strings.Split(src, "\n") {
+		line, _, _ = strings.Cut(line, ";")
+		fields := strings.Fields(strings.ToUpper(line))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("cpu6502: line %d: unexpected %q", n+1, fields[2])
+		}
+		operand := ""
+		if len(fields) == 2 {
+			operand = fields[1]
+		}
+		b, err := assemble(fields[0], operand)
+		if err != nil {
+			return nil, fmt.Errorf("cpu6502: line %d: %v", n+1, err)
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+func assemble(mnemonic, operand string) ([]byte, error) {
+	if mnemonic == "BRK" {
+		if operand == "" {
+			return []byte{0x00}, nil
+		}
+		v, _, err := parseNumber(operand)
+		if err != nil || v > 0xff {
+			return nil, fmt.Errorf("bad operand %q", operand)
+		}
+		return []byte{0x00, byte(v)}, nil
+	}
+	var inst *Instruction
+	for i := range Opcodes {
+		if funcName(Opcodes[i].F) == mnemonic {
+			inst = &Opcodes[i]
+			break
+		}
+	}
+	if inst == nil {
+		return nil, fmt.Errorf("unknown instruction %q", mnemonic)
+	}
+	modes, v, err := parseOperand(operand)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range modes {
+		c, ok := inst.code(m)
+		if !ok {
+			continue
+		}
+		switch m.operands() {
+		case 0:
+			return []byte{c}, nil
+		case 1:
+			if v > 0xff {
+				continue
+			}
+			return []byte{c, byte(v)}, nil
+		default:
+			return []byte{c, byte(v), byte(v >> 8)}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s does not support operand %q", mnemonic, operand)
+}
+
+// parseOperand returns the modes operand may be in, in order of preference,
+// and its value.
+func parseOperand(operand string) ([]Mode, uint16, error) {
+	switch {
+	case operand == "" || operand == "A":
+		return []Mode{MODE_SNGL}, 0, nil
+	case strings.HasPrefix(operand, "#"):
+		v, _, err := parseNumber(operand[1:])
+		if err != nil || v > 0xff {
+			return nil, 0, fmt.Errorf("bad operand %q", operand)
+		}
+		return []Mode{MODE_IMM}, v, nil
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ",X)"):
+		v, _, err := parseNumber(operand[1 : len(operand)-3])
+		return []Mode{MODE_INDX}, v, err
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, "),Y"):
+		v, _, err := parseNumber(operand[1 : len(operand)-3])
+		return []Mode{MODE_INDY}, v, err
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ")"):
+		v, _, err := parseNumber(operand[1 : len(operand)-1])
+		return []Mode{MODE_IND}, v, err
+	}
+	addr, index, _ := strings.Cut(operand, ",")
+	v, wide, err := parseNumber(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	var modes []Mode
+	switch index {
+	case "":
+		modes = []Mode{MODE_ZP, MODE_ABS, MODE_BRA}
+	case "X":
+		modes = []Mode{MODE_ZPX, MODE_ABSX}
+	case "Y":
+		modes = []Mode{MODE_ZPY, MODE_ABSY}
+	default:
+		return nil, 0, fmt.Errorf("bad index %q", index)
+	}
+	if wide {
+		modes = modes[1:]
+	}
+	return modes, v, nil
+}
+
+// parseNumber parses a $-prefixed hexadecimal or a decimal number. wide
+// reports whether it was written with more than two hex digits.
+func parseNumber(s string) (v uint16, wide bool, err error) {
+	base := 10
+	if strings.HasPrefix(s, "$") {
+		s = s[1:]
+		base = 16
+		wide = len(s) > 2
+	}
+	n, err := strconv.ParseUint(s, base, 16)
+	if err != nil {
+		return 0, false, fmt.Errorf("bad number %q", s)
+	}
+	return uint16(n), wide || n > 0xff, nil
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2014 Maddy Blue <github@maddy.blue>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cpu6502
+
+import "fmt"
+
+// operands returns the number of operand bytes that follow an opcode in
+// mode m.
+func (m Mode) operands() int {
+	switch m {
+	case MODE_SNGL:
+		return 0
+	case MODE_ABS, MODE_ABSX, MODE_ABSY, MODE_IND, MODE_ZPREL, MODE_ABSXIND:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Disassemble decodes the NMOS instruction at pc. It returns the
+// instruction as assembly text and the address of the following
+// instruction. Branch operands are shown as the raw offset, as in Log.
+func Disassemble(m Memory, pc uint16) (text string, next uint16) {
+	return Optable.Disassemble(m, pc)
+}
+
+// DisassembleRange disassembles the NMOS instructions between start and
+// end, inclusive, each prefixed by its address. An instruction that does not
+// fit completely before end is omitted. If sym contains the target of a JMP,
+// JSR, or branch, the symbol is shown in place of the operand.
+func DisassembleRange(m Memory, start, end uint16, sym map[uint16]string) []string {
+	return Optable.DisassembleRange(m, start, end, sym)
+}
+
+// Disassemble is like the Disassemble function, but decodes the
+// instruction set of c from c.M.
+func (c *Cpu) Disassemble(pc uint16) (text string, next uint16) {
+	return c.ops().Disassemble(c.M, pc)
+}
+
+// DisassembleRange is like the DisassembleRange function, but decodes the
+// instruction set of c from c.M.
+func (c *Cpu) DisassembleRange(start, end uint16, sym map[uint16]string) []string {
+	return c.ops().DisassembleRange(c.M, start, end, sym)
+}
+
+// Disassemble is like the Disassemble function, but decodes the
+// instruction set of t.
+func (t *OpTable) Disassemble(m Memory, pc uint16) (text string, next uint16) {
+	o := t[m.Read(pc)]
+	next = pc + 1
+	var b byte
+	var v, w uint16
+	switch o.Mode.operands() {
+	case 1:
+		b = m.Read(next)
+		v, w = uint16(b), uint16(b)
+	case 2:
+		v = uint16(m.Read(next)) | uint16(m.Read(next+1))<<8
+		w = v
+		if o.Mode == MODE_ZPREL {
+			w, v = v&0xff, v>>8
+		}
+	}
+	next += uint16(o.Mode.operands())
+	text = o.String()
+	if f := o.Mode.Format(); f != "" {
+		text += " " + fmt.Sprintf(f, b, v, w)
+	}
+	return text, next
+}
+
+// DisassembleRange is like the DisassembleRange function, but decodes the
+// instruction set of t.
+func (t *OpTable) DisassembleRange(m Memory, start, end uint16, sym map[uint16]string) []string {
+	var s []string
+	for pc := int(start); pc <= int(end); {
+		text, next := t.Disassemble(m, uint16(pc))
+		size := int(next - uint16(pc))
+		if pc+size-1 > int(end) {
+			break
+		}
+		if target, ok := t.jumpTarget(m, uint16(pc), next); ok {
+			if name, ok := sym[target]; ok {
+				text = t[m.Read(uint16(pc))].String() + " " + name
+			}
+		}
+		s = append(s, fmt.Sprintf("%04X: %s", pc, text))
+		pc += size
+	}
+	return s
+}
+
+// jumpTarget returns the destination of the JMP, JSR, or branch at pc,
+// whose following instruction is at next.
+func (t *OpTable) jumpTarget(m Memory, pc, next uint16) (uint16, bool) {
+	inst := m.Read(pc)
+	o := t[inst]
+	switch {
+	case o.Mode == MODE_BRA && inst != 0:
+		return next + uint16(int8(m.Read(pc+1))), true
+	case o.Mode == MODE_ABS && (o.String() == "JMP" || o.String() == "JSR"):
+		return uint16(m.Read(pc+1)) | uint16(m.Read(pc+2))<<8, true
+	}
+	return 0, false
+}
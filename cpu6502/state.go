@@ -0,0 +1,145 @@
+/*
+ * Copyright (c) 2014 Maddy Blue <github@maddy.blue>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cpu6502
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// stateVersion is the first byte of the output of MarshalBinary. Version 2
+// added Cycles, version 3 OpenBus, and version 4 Variant.
+const stateVersion = 4
+
+const (
+	stateHalt = 1 << iota
+	stateDisableDecimal
+	stateFixIndirectJMP
+	stateWaiting
+)
+
+// MarshalBinary encodes the registers and execution state of c. Memory,
+// the Ticker, and the log are not included.
+func (c *Cpu) MarshalBinary() ([]byte, error) {
+	b := []byte{stateVersion, c.A, c.X, c.Y, c.S, c.P}
+	b = binary.LittleEndian.AppendUint16(b, c.PC)
+	var flags byte
+	if c.Halt {
+		flags |= stateHalt
+	}
+	if c.DisableDecimal {
+		flags |= stateDisableDecimal
+	}
+	if c.FixIndirectJMP {
+		flags |= stateFixIndirectJMP
+	}
+	if c.Waiting {
+		flags |= stateWaiting
+	}
+	b = append(b, flags)
+	b = binary.LittleEndian.AppendUint32(b, uint32(c.stepCycles))
+	b = binary.LittleEndian.AppendUint64(b, c.Cycles)
+	b = append(b, c.OpenBus, byte(c.Variant))
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(c.TimingOverride)))
+	for i := 0; i <= 0xff; i++ {
+		if n, ok := c.TimingOverride[byte(i)]; ok {
+			b = append(b, byte(i))
+			b = binary.LittleEndian.AppendUint32(b, uint32(n))
+		}
+	}
+	return b, nil
+}
+
+var errShortState = errors.New("cpu6502: short state")
+
+// UnmarshalBinary restores state encoded by MarshalBinary.
+func (c *Cpu) UnmarshalBinary(b []byte) error {
+	if len(b) < 1 {
+		return errShortState
+	}
+	version := b[0]
+	if version < 1 || version > stateVersion {
+		return fmt.Errorf("cpu6502: unknown state version %d", version)
+	}
+	if len(b) < 15 {
+		return errShortState
+	}
+	r := Register{
+		A:  b[1],
+		X:  b[2],
+		Y:  b[3],
+		S:  b[4],
+		P:  b[5],
+		PC: binary.LittleEndian.Uint16(b[6:]),
+	}
+	flags := b[8]
+	cycles := int(binary.LittleEndian.Uint32(b[9:]))
+	b = b[13:]
+	var total uint64
+	if version >= 2 {
+		if len(b) < 10 {
+			return errShortState
+		}
+		total = binary.LittleEndian.Uint64(b)
+		b = b[8:]
+	}
+	var bus byte
+	if version >= 3 {
+		if len(b) < 3 {
+			return errShortState
+		}
+		bus = b[0]
+		b = b[1:]
+	}
+	variant := c.Variant
+	if version >= 4 {
+		if len(b) < 3 {
+			return errShortState
+		}
+		variant = Variant(b[0])
+		if variant < NMOS || variant > WDC65C02 {
+			return fmt.Errorf("cpu6502: unknown variant %d", variant)
+		}
+		b = b[1:]
+	}
+	n := int(binary.LittleEndian.Uint16(b))
+	b = b[2:]
+	if len(b) != n*5 {
+		return errShortState
+	}
+	var timing map[byte]int
+	if n > 0 {
+		timing = make(map[byte]int, n)
+		for ; len(b) > 0; b = b[5:] {
+			timing[b[0]] = int(binary.LittleEndian.Uint32(b[1:]))
+		}
+	}
+	if variant != c.Variant || c.Ops == nil {
+		c.setVariant(variant)
+	}
+	c.Register = r
+	c.Halt = flags&stateHalt != 0
+	c.DisableDecimal = flags&stateDisableDecimal != 0
+	c.FixIndirectJMP = flags&stateFixIndirectJMP != 0
+	c.Waiting = flags&stateWaiting != 0
+	c.stepCycles = cycles
+	c.Cycles = total
+	c.OpenBus = bus
+	c.TimingOverride = timing
+	return nil
+}
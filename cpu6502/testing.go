@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2014 Maddy Blue <github@maddy.blue>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package cpu6502
+
+// Ram is a flat 64KB Memory with no memory-mapped devices.
+type Ram []byte
+
+func (r Ram) Read(v uint16) byte     { return r[v] }
+func (r Ram) Write(v uint16, b byte) { r[v] = b }
+
+// NewWithRAM returns a Cpu backed by a new 64KB Ram with program copied to
+// loadAt and PC set to loadAt. It is intended for tests.
+func NewWithRAM(program []byte, loadAt uint16) (*Cpu, Ram) {
+	r := make(Ram, 0xffff+1)
+	copy(r[loadAt:], program)
+	c := New(r)
+	c.PC = loadAt
+	return c, r
+}
+
+// CountingTicker is a Ticker that counts cycles. If Cpu is set, the PC at
+// each tick is also recorded.
+type CountingTicker struct {
+	Ticks int
+	Cpu   *Cpu
+	PCs   []uint16
+}
+
+func (t *CountingTicker) Tick() {
+	t.Ticks++
+	if t.Cpu != nil {
+		t.PCs = append(t.PCs, t.Cpu.PC)
+	}
+}
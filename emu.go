@@ -3,6 +3,11 @@ package nsf
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/maddyblue/nsf/cpu6502"
@@ -11,6 +16,16 @@ import (
 const (
 	// 1.79 MHz
 	cpuClock = 236250000 / 11 / 12
+	// 1.66 MHz
+	cpuClockPAL = 26601712 / 16
+
+	// The frame sequencer runs at 240 Hz on NTSC and 200 Hz on PAL.
+	frameRate    = 240
+	frameRatePAL = 200
+
+	// Default play routine periods, in microseconds.
+	speedNTSC = 16639
+	speedPAL  = 19997
 )
 
 var (
@@ -30,8 +45,31 @@ type Song struct {
 	Duration time.Duration
 	// After Duration, fade out. Set to 0 to end immediately.
 	Fade time.Duration
+
+	// timed and faded are set if Duration and Fade are from the file.
+	timed, faded bool
+}
+
+// TrackInfo describes a song for display in a track list.
+type TrackInfo struct {
+	// Index is the 1-based song number passed to Init.
+	Index int
+	// Label is the song name, or "Track N" if it has none.
+	Label    string
+	Duration time.Duration
+	Fade     time.Duration
 }
 
+// Region is a television system, which determines playback timing.
+type Region byte
+
+const (
+	NTSC Region = 1 << iota
+	PAL
+	// Dual tunes support both NTSC and PAL.
+	Dual = NTSC | PAL
+)
+
 type NSF struct {
 	*cpu6502.Cpu
 
@@ -41,27 +79,92 @@ type NSF struct {
 	// SampleRate is the sample rate at which samples will be generated. If not
 	// set before Init(), it is set to DefaultSampleRate.
 	SampleRate int64
+	// PlayRegion is the region used for playback. If not set to NTSC or PAL
+	// before Init(), it is set to Preferred.
+	PlayRegion Region
+	// NonFinite counts generated samples that were NaN or infinite and
+	// were replaced with silence.
+	NonFinite int
+	// DMCStealsCycles stalls the CPU for the cycles the DMC channel takes
+	// to fetch sample bytes, as the hardware does. It is enabled by the
+	// readers.
+	DMCStealsCycles bool
+	// NoiseInverted makes the noise channel sound while bit 0 of its shift
+	// register is set, as some emulators do, rather than while it is clear.
+	NoiseInverted bool
+	// VRC7PatchSet is the instrument ROM used for VRC7 audio.
+	VRC7PatchSet VRC7PatchSet
+	// Debug records extra state about generated samples, such as the values
+	// returned by MixDebug and ClipCount.
+	Debug bool
 
-	// Start is the 0-based index of the starting song
-	Start     byte
-	Songs     []Song
-	Copyright string
-	Artist    string
-	Game      string
+	// Version is the version of an NSF file, or 0 for NSFe files.
+	Version byte
+	// NSF2 holds the feature flags of an NSF2 file.
+	NSF2 NSF2Flags
+
+	// Start is the starting song as stored in the file: 1-based in NSF
+	// files and 0-based in NSFe files. StartingSong is always 1-based.
+	Start byte
+	// TotalSongs is the number of songs.
+	TotalSongs byte
+	// StartingSong is the 1-based index of the song to play first.
+	StartingSong byte
+	Songs        []Song
+	Copyright    string
+	Artist       string
+	Game         string
+	// Ripper is the person who ripped the tune, from the NSFe auth chunk.
+	Ripper string
+	// Comment is free-form text about the tune, from the NSFe text chunk.
+	Comment string
 
 	LoadAddr uint16
 	InitAddr uint16
 	PlayAddr uint16
 
-	SpeedNTSC  uint16
+	// Region is the set of regions the tune supports. Preferred is the
+	// region it should play in by default.
+	Region    Region
+	Preferred Region
+
+	// Info is the INFO chunk of an NSFe file, or nil for NSF files.
+	Info *NSFEInfo
+
+	// SpeedNTSC and SpeedPAL are the periods, in microseconds, at which
+	// the play routine is called in each region. If 0, the standard
+	// period is used.
+	SpeedNTSC uint16
+	SpeedPAL  uint16
+	// ExpansionChips are the expansion sound chips the tune uses.
+	ExpansionChips Chips
+	// MixLevels are the mixing levels of devices in dB, from the NSFe
+	// mixe chunk. Devices not present are at 0 dB.
+	MixLevels  map[Device]float64
 	Bankswitch [8]byte
 	Data       []byte
+	// lazyData is the program data of a tune opened with NewReaderAt,
+	// read into Data by Init.
+	lazyData *io.SectionReader
+
+	// playlist is the play order from the NSFe plst chunk.
+	playlist []int
 
 	ram         *ram
+	clock       int64 // CPU clock rate of PlayRegion
+	frameLen    int64 // cycles per frame sequencer step
 	totalTicks  int64
 	frameTicks  int64
 	sampleTicks int64
 	playTicks   int64
+	inPlay      bool // within a play period
+	lastPlay    int64
+	plays       int64
+	playTotal   int64
+	stall       int // cycles stolen from the CPU by DMC fetches
+	mix         MixSnapshot
+	clipped     uint64
+	trace       []cpu6502.Log
 	samples     []float32
 	prevs       [4]float32
 	pi          int // prevs index
@@ -76,23 +179,55 @@ type NSF struct {
 	song Song
 }
 
+// Tick advances the APU by one CPU cycle, followed by any cycles the DMC
+// stole from the CPU to fetch sample bytes.
 func (n *NSF) Tick() {
+	n.tick()
+	for n.stall > 0 {
+		n.stall--
+		n.tick()
+	}
+}
+
+func (n *NSF) tick() {
 	n.ram.A.Step()
+	for _, v := range n.ram.voices {
+		v.Clock()
+	}
+	if a, ok := n.ram.A.dmc.Fetch(); ok {
+		n.ram.A.dmc.Fill(n.ram.Read(a))
+		if n.DMCStealsCycles {
+			n.stall += 4
+		}
+	}
 	n.totalTicks++
 	n.frameTicks++
-	if n.frameTicks == cpuClock/240 {
+	if n.frameTicks == n.frameLen {
 		n.frameTicks = 0
 		n.ram.A.FrameStep()
 	}
 	n.sampleTicks++
-	if n.SampleRate > 0 && n.sampleTicks >= cpuClock/n.SampleRate {
+	if n.SampleRate > 0 && n.sampleTicks >= n.clock/n.SampleRate {
 		n.sampleTicks = 0
-		n.append(n.ram.A.Volume())
+		if n.Debug {
+			n.mix = n.ram.A.Snapshot()
+		}
+		n.append(n.ram.Volume())
 	}
 	n.playTicks++
 }
 
 func (n *NSF) append(v float32) {
+	if f := float64(v); math.IsNaN(f) || math.IsInf(f, 0) {
+		n.NonFinite++
+		v = 0
+	}
+	if v > 1 || v < -1 {
+		if n.Debug {
+			n.clipped++
+		}
+		v = float32(math.Max(-1, math.Min(1, float64(v))))
+	}
 	if v != 0 {
 		n.zero = false
 	}
@@ -109,57 +244,224 @@ func (n *NSF) append(v float32) {
 	n.samples = append(n.samples, sum)
 }
 
+// Bankswitched reports whether n uses bankswitching, which is when any of
+// its initial banks is nonzero.
+func (n *NSF) Bankswitched() bool {
+	return n.Bankswitch != [8]byte{}
+}
+
+// HasVRC6 reports whether the tune uses the Konami VRC6.
+func (n *NSF) HasVRC6() bool { return n.ExpansionChips&ChipVRC6 != 0 }
+
+// HasVRC7 reports whether the tune uses the Konami VRC7.
+func (n *NSF) HasVRC7() bool { return n.ExpansionChips&ChipVRC7 != 0 }
+
+// HasFDS reports whether the tune uses the Famicom Disk System.
+func (n *NSF) HasFDS() bool { return n.ExpansionChips&ChipFDS != 0 }
+
+// HasMMC5 reports whether the tune uses the Nintendo MMC5.
+func (n *NSF) HasMMC5() bool { return n.ExpansionChips&ChipMMC5 != 0 }
+
+// HasN163 reports whether the tune uses the Namco 163.
+func (n *NSF) HasN163() bool { return n.ExpansionChips&ChipN163 != 0 }
+
+// HasSunsoft5B reports whether the tune uses the Sunsoft 5B.
+func (n *NSF) HasSunsoft5B() bool { return n.ExpansionChips&ChipSunsoft5B != 0 }
+
+// TrackName returns the name of the 1-based song idx, or "" if it has none.
+func (n *NSF) TrackName(idx int) string {
+	if idx < 1 || idx > len(n.Songs) {
+		return ""
+	}
+	return n.Songs[idx-1].Name
+}
+
+// TrackDuration returns the length of the 1-based song idx given by the
+// file. It returns false if the file does not give one, in which case the
+// default length should be used.
+func (n *NSF) TrackDuration(idx int) (time.Duration, bool) {
+	if idx < 1 || idx > len(n.Songs) || !n.Songs[idx-1].timed {
+		return 0, false
+	}
+	return n.Songs[idx-1].Duration, true
+}
+
+// TrackFade returns the fade out length of the 1-based song idx given by
+// the file. It returns false if the file does not give one, in which case
+// the default fade should be used.
+func (n *NSF) TrackFade(idx int) (time.Duration, bool) {
+	if idx < 1 || idx > len(n.Songs) || !n.Songs[idx-1].faded {
+		return 0, false
+	}
+	return n.Songs[idx-1].Fade, true
+}
+
+// Playlist returns the 0-based song indices, as stored in the NSFe plst
+// chunk, in the order they are meant to be played, which may skip or
+// repeat songs. It returns nil if the file does not give an order, in which
+// case songs 0 to TotalSongs-1 play in order. Add 1 to an index to pass it
+// to Init.
+func (n *NSF) Playlist() []int {
+	return slices.Clone(n.playlist)
+}
+
+// Tracks returns information about each song in n.
+func (n *NSF) Tracks() []TrackInfo {
+	t := make([]TrackInfo, len(n.Songs))
+	for i, s := range n.Songs {
+		t[i] = TrackInfo{
+			Index:    i + 1,
+			Label:    s.Name,
+			Duration: s.Duration,
+			Fade:     s.Fade,
+		}
+		if t[i].Label == "" {
+			t[i].Label = fmt.Sprintf("Track %d", i+1)
+		}
+	}
+	return t
+}
+
+// maxInitCycles bounds the number of cycles the init routine may run
+// before Init gives up on it.
+var maxInitCycles = 20000000
+
 // Init initializes the 1-based song for playing. Only one song my play
-// at once. An invalid song index will play the first song.
-func (n *NSF) Init(song int) {
-	if len(n.Songs) < song || song < 0 {
-		song = 1
+// at once. A song index outside 1 to len(n.Songs) returns ErrBadSong. If
+// the init routine does not return, Init returns ErrInitTimeout, or ErrInitHalted
+// if it halts the CPU. NSF2 tunes with NSF2NonReturningInit are rejected
+// with ErrNonReturningInit.
+func (n *NSF) Init(song int) error {
+	if n.NSF2&NSF2NonReturningInit != 0 {
+		return ErrNonReturningInit
+	}
+	if err := n.loadData(); err != nil {
+		return err
+	}
+	if song < 1 || song > len(n.Songs) {
+		return ErrBadSong
 	}
 	n.song = n.Songs[song-1]
 	if n.SampleRate == 0 {
 		n.SampleRate = DefaultSampleRate
 	}
+	if n.PlayRegion != NTSC && n.PlayRegion != PAL {
+		n.PlayRegion = n.Preferred
+	}
+	n.clock, n.frameLen = cpuClock, cpuClock/frameRate
+	if n.PlayRegion == PAL {
+		n.clock, n.frameLen = cpuClockPAL, cpuClockPAL/frameRatePAL
+	}
+	n.totalTicks, n.frameTicks, n.sampleTicks, n.playTicks = 0, 0, 0, 0
+	n.stall = 0
+	n.inPlay, n.lastPlay, n.plays, n.playTotal = false, 0, 0, 0
+	n.prevs, n.pi = [4]float32{}, 0
+	n.buf.Reset()
+	n.silent, n.played = 0, 0
 	n.ram = new(ram)
-	copy(n.ram.M[n.LoadAddr:], n.Data)
+	if n.Bankswitched() {
+		n.ram.loadBanks(n.Data, n.LoadAddr, n.Bankswitch, n.HasFDS())
+	} else {
+		copy(n.ram.M[n.LoadAddr:], n.Data)
+	}
 	n.Cpu = cpu6502.New(n.ram)
+	n.Cpu.L = n.trace
 	n.Cpu.DisableDecimal = true
 	n.Cpu.P = 0x24
 	n.Cpu.S = 0xfd
+	n.ram.A.PAL = n.PlayRegion == PAL
 	n.ram.A.Init()
+	n.ram.A.noise.Inverted = n.NoiseInverted
+	n.ram.pulseGain, n.ram.tndGain = n.gain(DeviceAPU1), n.gain(DeviceAPU2)
+	if n.HasVRC6() {
+		n.addChip(new(vrc6), DeviceVRC6)
+	}
+	if n.HasVRC7() {
+		n.addChip(newVRC7(n.VRC7PatchSet), DeviceVRC7)
+	}
+	if n.HasFDS() {
+		n.addChip(newFDS(), DeviceFDS)
+	}
+	if n.HasMMC5() {
+		n.addChip(new(mmc5), DeviceMMC5)
+	}
+	if n.HasN163() {
+		n.addChip(new(n163), DeviceN163)
+	}
 	n.Cpu.A = byte(song - 1)
-	n.Cpu.PC = n.InitAddr
-	n.Cpu.Run()
+	n.call(n.InitAddr)
+	if _, err := n.Cpu.RunUntil(0, maxInitCycles); err == cpu6502.ErrHalted {
+		return ErrInitHalted
+	} else if err != nil {
+		return ErrInitTimeout
+	}
 	n.Cpu.T = n
+	return nil
+}
+
+// addChip adds the expansion chip c. If c generates sound, it is mixed at
+// the level of device d given by MixLevels.
+func (n *NSF) addChip(c chip, d Device) {
+	n.ram.chips = append(n.ram.chips, c)
+	if a, ok := c.(audioChip); ok {
+		n.ram.voices = append(n.ram.voices, voice{a, n.gain(d)})
+	}
+}
+
+// gain returns the linear gain of device d from its level in MixLevels.
+func (n *NSF) gain(d Device) float32 {
+	return float32(math.Pow(10, n.MixLevels[d]/20))
+}
+
+// call prepares the CPU to run the routine at addr as if called with JSR
+// from a fresh stack. Its final RTS returns to PC 0.
+func (n *NSF) call(addr uint16) {
+	n.ram.Write(0x1ff, 0xff)
+	n.ram.Write(0x1fe, 0xff)
+	n.Cpu.S = 0xfd
+	n.Cpu.PC = addr
 }
 
 func (n *NSF) step() {
 	n.Cpu.Step()
-	if !n.Cpu.I() && n.ram.A.Interrupt {
-		n.Cpu.Interrupt()
+	if n.ram.A.Interrupt || n.ram.A.dmc.Interrupt {
+		n.Cpu.IRQ()
 	}
 }
 
 // Play returns the requested number of samples. If less are returned,
 // the silence check or time limit have been reached.
 func (n *NSF) Play(samples int) []float32 {
-	playDur := time.Duration(n.SpeedNTSC) * time.Nanosecond * 1000
+	playDur := n.PlayPeriod()
 	sampleDur := time.Duration(samples) * time.Second / time.Duration(n.SampleRate)
 	n.played += sampleDur
 	if n.song.Duration > 0 && n.played > n.song.Duration {
 		return nil
 	}
-	ticksPerPlay := int64(playDur / (time.Second / cpuClock))
+	ticksPerPlay := n.cycles(playDur)
 	n.samples = make([]float32, 0, samples)
 	n.zero = true
 	for len(n.samples) < samples {
-		n.playTicks = 0
-		n.Cpu.PC = n.PlayAddr
+		// A play period may span calls to Play, so resume it if needed.
+		if !n.inPlay {
+			n.inPlay = true
+			n.playTicks = 0
+			n.call(n.PlayAddr)
+		}
 		for n.Cpu.PC != 0 && len(n.samples) < samples {
 			n.step()
+			if n.Cpu.PC == 0 {
+				n.lastPlay = n.playTicks
+				n.plays++
+				n.playTotal += n.playTicks
+			}
 		}
-		for i := ticksPerPlay - n.playTicks; i > 0 && len(n.samples) < samples; i-- {
+		for n.playTicks < ticksPerPlay && len(n.samples) < samples {
 			n.Tick()
 		}
+		if n.Cpu.PC == 0 && n.playTicks >= ticksPerPlay {
+			n.inPlay = false
+		}
 	}
 	if n.zero {
 		n.silent += sampleDur
@@ -172,6 +474,39 @@ func (n *NSF) Play(samples int) []float32 {
 	return n.samples
 }
 
+// LastPlayCycles returns the number of CPU cycles the last completed call
+// to the play routine took.
+func (n *NSF) LastPlayCycles() int {
+	return int(n.lastPlay)
+}
+
+// AveragePlayCycles returns the average number of CPU cycles of the
+// completed calls to the play routine since Init.
+func (n *NSF) AveragePlayCycles() float64 {
+	if n.plays == 0 {
+		return 0
+	}
+	return float64(n.playTotal) / float64(n.plays)
+}
+
+// PlayPeriod returns the time between calls to the play routine in
+// PlayRegion.
+func (n *NSF) PlayPeriod() time.Duration {
+	speed, def := n.SpeedNTSC, uint16(speedNTSC)
+	if n.PlayRegion == PAL {
+		speed, def = n.SpeedPAL, speedPAL
+	}
+	if speed == 0 {
+		speed = def
+	}
+	return time.Duration(speed) * time.Microsecond
+}
+
+// cycles returns the number of CPU cycles in d.
+func (n *NSF) cycles(d time.Duration) int64 {
+	return int64(d / (time.Second / time.Duration(n.clock)))
+}
+
 func (nsf *NSF) Read(p []byte) (n int, err error) {
 	// if readbuf has < p bytes, fill up read buf
 	for nsf.buf.Len() < len(p) {
@@ -189,39 +524,160 @@ func (nsf *NSF) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// MixDebug returns the mixer state of the last generated sample. It is only
+// recorded if Debug is set.
+func (n *NSF) MixDebug() MixSnapshot {
+	return n.mix
+}
+
+// ClipCount returns the number of samples clamped to [-1, 1] while Debug
+// was set.
+func (n *NSF) ClipCount() uint64 {
+	return n.clipped
+}
+
+// EnableCPUTrace records the last size CPU instructions executed, which
+// CPUTrace returns. The buffer is kept across calls to Init. A size of 0
+// disables tracing.
+func (n *NSF) EnableCPUTrace(size int) {
+	n.trace = nil
+	if size > 0 {
+		n.trace = make([]cpu6502.Log, size)
+	}
+	if n.Cpu != nil {
+		n.Cpu.L = n.trace
+		n.Cpu.LI = 0
+	}
+}
+
+// CPUTrace returns the instructions recorded since EnableCPUTrace.
+func (n *NSF) CPUTrace() string {
+	if n.Cpu == nil || n.Cpu.L == nil {
+		return ""
+	}
+	return n.Cpu.StringLog()
+}
+
+// Buffered returns the number of samples that have been generated but not
+// yet returned by Read.
+func (n *NSF) Buffered() int {
+	return n.buf.Len() / 4
+}
+
 // little-endian [2]byte to uint16 conversion
 func bLEtoUint16(b []byte) uint16 {
 	return uint16(b[1])<<8 + uint16(b[0])
 }
 
-// null-terminated bytes to string
+// bToString returns the string in the null-padded field b, without
+// trailing nulls or spaces.
 func bToString(b []byte) string {
-	i := 0
-	for i = range b {
-		if b[i] == 0 {
-			break
-		}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
 	}
-	return string(b[:i])
+	return strings.TrimRight(string(b), " ")
 }
 
 type ram struct {
 	M [0xffff + 1]byte
 	A apu
+	// rom holds the 4KB banks of a bankswitched tune.
+	rom []byte
+	// fds is set if $5FF6 and $5FF7 switch banks at $6000-$7FFF.
+	fds bool
+	// chips are the expansion chips the tune uses.
+	chips []chip
+	// voices are the chips that generate sound.
+	voices []voice
+	// pulseGain and tndGain scale the APU pulse and triangle/noise/DMC
+	// outputs.
+	pulseGain, tndGain float32
+}
+
+// Volume returns the mixed output of the APU and expansion chips.
+func (r *ram) Volume() float32 {
+	p, t := r.A.Mix()
+	v := r.pulseGain*pulseOut[p] + r.tndGain*tndOut[t]
+	for _, c := range r.voices {
+		v += c.gain * c.Volume()
+	}
+	return v
+}
+
+// A chip is an expansion chip with registers in the CPU address space.
+type chip interface {
+	// Read returns the value of the register at v and whether v is a
+	// readable register of the chip.
+	Read(v uint16) (byte, bool)
+	// Write writes the register at v and reports whether v is a register
+	// of the chip.
+	Write(v uint16, b byte) bool
+}
+
+// An audioChip is an expansion chip that generates sound.
+type audioChip interface {
+	chip
+	// Clock advances the chip by one CPU cycle.
+	Clock()
+	// Volume returns the output of the chip, on the scale of the APU.
+	Volume() float32
+}
+
+// A voice is an audioChip mixed at a gain.
+type voice struct {
+	audioChip
+	gain float32
 }
 
 func (r *ram) Read(v uint16) byte {
-	switch v {
-	case 0x4015:
+	if v == 0x4015 {
 		return r.A.Read(v)
-	default:
-		return r.M[v]
 	}
+	for _, c := range r.chips {
+		if b, ok := c.Read(v); ok {
+			return b
+		}
+	}
+	return r.M[v]
+}
+
+// loadBanks splits data loaded at addr into 4KB banks, and maps the
+// initial banks into $8000-$FFFF. FDS tunes also map the last two into
+// $6000-$7FFF.
+func (r *ram) loadBanks(data []byte, addr uint16, banks [8]byte, fds bool) {
+	pad := int(addr & 0xfff)
+	r.rom = make([]byte, (pad+len(data)+0xfff)&^0xfff)
+	copy(r.rom[pad:], data)
+	r.fds = fds
+	for i, b := range banks {
+		r.bank(8+i, b)
+	}
+	if fds {
+		r.bank(6, banks[6])
+		r.bank(7, banks[7])
+	}
+}
+
+// bank maps bank b of the ROM into the 4KB page at page*$1000. Banks past
+// the end of the ROM are filled with zeros.
+func (r *ram) bank(page int, b byte) {
+	m := r.M[page*0x1000:][:0x1000]
+	n := copy(m, r.rom[min(int(b)*0x1000, len(r.rom)):])
+	clear(m[n:])
 }
 
 func (r *ram) Write(v uint16, b byte) {
+	if r.rom != nil && (v >= 0x5ff8 && v <= 0x5fff || r.fds && (v == 0x5ff6 || v == 0x5ff7)) {
+		r.bank(int(v-0x5ff0), b)
+		return
+	}
+	for _, c := range r.chips {
+		if c.Write(v, b) {
+			return
+		}
+	}
 	r.M[v] = b
-	if v&0xf000 == 0x4000 {
+	if v >= 0x4000 && v <= 0x4017 {
 		r.A.Write(v, b)
 	}
 }
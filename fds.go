@@ -0,0 +1,205 @@
+package nsf
+
+// fds is the sound hardware of the Famicom Disk System: a 64 step
+// wavetable channel whose pitch is modulated by a second unit stepping
+// through a 32 entry table of pitch adjustments.
+type fds struct {
+	Wave      [64]byte
+	WaveWrite bool // wavetable writable, and the channel held
+	Pitch     uint16
+	WaveHalt  bool
+	EnvHalt   bool
+	WavePos   uint32 // the top 6 of 22 bits index Wave
+	Master    byte   // master volume, 0 to 3
+	EnvSpeed  byte   // master envelope speed, $408A
+	Out       byte   // last wavetable sample
+
+	Vol fdsEnvelope
+	Mod fdsEnvelope
+
+	ModTable   [32]byte
+	ModWrite   byte   // next ModTable entry written by $4088
+	ModPos     byte   // 0 to 63; each ModTable entry is used twice
+	ModAcc     uint32 // steps ModPos on overflow of 16 bits
+	ModPitch   uint16
+	ModHalt    bool
+	ModCounter int8 // 7-bit signed
+}
+
+// fdsEnvelope is the volume or modulation depth envelope.
+type fdsEnvelope struct {
+	Disable  bool
+	Increase bool
+	Speed    byte
+	Gain     byte
+	Tick     int
+}
+
+// fdsModStep is the ModCounter adjustment of each ModTable value. 4 resets
+// the counter.
+var fdsModStep = [8]int8{0, 1, 2, 4, 0, -4, -2, -1}
+
+// fdsMaster is the master volume scale of each Master value.
+var fdsMaster = [4]float32{2.0 / 2, 2.0 / 3, 2.0 / 4, 2.0 / 5}
+
+func newFDS() *fds {
+	return &fds{EnvSpeed: 0xe8}
+}
+
+func (f *fds) Read(v uint16) (byte, bool) {
+	switch {
+	case v >= 0x4040 && v <= 0x407f:
+		return f.Wave[v-0x4040], true
+	case v == 0x4090:
+		return f.Vol.Gain, true
+	case v == 0x4092:
+		return f.Mod.Gain, true
+	}
+	return 0, false
+}
+
+func (f *fds) Write(v uint16, b byte) bool {
+	switch {
+	case v >= 0x4040 && v <= 0x407f:
+		if f.WaveWrite {
+			f.Wave[v-0x4040] = b & 0x3f
+		}
+	case v == 0x4080:
+		f.Vol.Control(b)
+	case v == 0x4082:
+		f.Pitch = f.Pitch&0xf00 | uint16(b)
+	case v == 0x4083:
+		f.Pitch = f.Pitch&0xff | uint16(b&0xf)<<8
+		f.WaveHalt = b&0x80 != 0
+		f.EnvHalt = b&0x40 != 0
+		if f.WaveHalt {
+			f.WavePos = 0
+		}
+	case v == 0x4084:
+		f.Mod.Control(b)
+	case v == 0x4085:
+		f.ModCounter = int8(b<<1) >> 1
+	case v == 0x4086:
+		f.ModPitch = f.ModPitch&0xf00 | uint16(b)
+	case v == 0x4087:
+		f.ModPitch = f.ModPitch&0xff | uint16(b&0xf)<<8
+		f.ModHalt = b&0x80 != 0
+		if f.ModHalt {
+			f.ModAcc = 0
+		}
+	case v == 0x4088:
+		if f.ModHalt {
+			f.ModTable[f.ModWrite] = b & 0x7
+			f.ModWrite = (f.ModWrite + 1) & 0x1f
+		}
+	case v == 0x4089:
+		f.WaveWrite = b&0x80 != 0
+		f.Master = b & 0x3
+	case v == 0x408a:
+		f.EnvSpeed = b
+	default:
+		return false
+	}
+	return true
+}
+
+func (e *fdsEnvelope) Control(b byte) {
+	e.Disable = b&0x80 != 0
+	e.Increase = b&0x40 != 0
+	e.Speed = b & 0x3f
+	e.Tick = 0
+	if e.Disable {
+		e.Gain = b & 0x3f
+	}
+}
+
+// Clock advances the envelope by one CPU cycle, given the master envelope
+// speed.
+func (e *fdsEnvelope) Clock(master byte) {
+	if e.Disable {
+		return
+	}
+	e.Tick++
+	if e.Tick < 8*(int(e.Speed)+1)*int(master) {
+		return
+	}
+	e.Tick = 0
+	if e.Increase && e.Gain < 32 {
+		e.Gain++
+	} else if !e.Increase && e.Gain > 0 {
+		e.Gain--
+	}
+}
+
+// Clock advances the channel by one CPU cycle.
+func (f *fds) Clock() {
+	if !f.EnvHalt && !f.WaveHalt && f.EnvSpeed != 0 {
+		f.Vol.Clock(f.EnvSpeed)
+		f.Mod.Clock(f.EnvSpeed)
+	}
+	pitch := f.Pitch
+	if !f.ModHalt && f.ModPitch != 0 {
+		f.ModAcc += uint32(f.ModPitch)
+		if f.ModAcc >= 0x10000 {
+			f.ModAcc -= 0x10000
+			f.stepMod()
+		}
+		pitch = f.modulate()
+	}
+	if f.WaveHalt || f.WaveWrite {
+		return
+	}
+	f.WavePos = (f.WavePos + uint32(pitch)) & 0x3fffff
+	f.Out = f.Wave[f.WavePos>>16]
+}
+
+// stepMod applies the next ModTable entry to ModCounter.
+func (f *fds) stepMod() {
+	m := f.ModTable[f.ModPos>>1]
+	f.ModPos = (f.ModPos + 1) & 0x3f
+	if m == 4 {
+		f.ModCounter = 0
+		return
+	}
+	// Wrap to 7 bits.
+	f.ModCounter = (f.ModCounter + fdsModStep[m]) << 1 >> 1
+}
+
+// modulate returns Pitch adjusted by the modulator, as the hardware
+// computes it.
+func (f *fds) modulate() uint16 {
+	temp := int(f.ModCounter) * int(f.Mod.Gain)
+	rem := temp & 0xf
+	temp >>= 4
+	if rem > 0 && temp&0x80 == 0 {
+		if f.ModCounter < 0 {
+			temp--
+		} else {
+			temp += 2
+		}
+	}
+	if temp >= 192 {
+		temp -= 256
+	} else if temp < -64 {
+		temp += 256
+	}
+	temp *= int(f.Pitch)
+	rem = temp & 0x3f
+	temp >>= 6
+	if rem >= 32 {
+		temp++
+	}
+	p := int(f.Pitch) + temp
+	if p < 0 {
+		return 0
+	}
+	return uint16(p)
+}
+
+// Volume returns the channel output, scaled to be about 2.4 times an APU
+// pulse channel at full volume.
+func (f *fds) Volume() float32 {
+	gain := min(f.Vol.Gain, 32)
+	out := float32(f.Out) * float32(gain) * fdsMaster[f.Master] / (63 * 32)
+	return out * 2.4 * pulseOut[15]
+}
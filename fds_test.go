@@ -0,0 +1,145 @@
+package nsf
+
+import "testing"
+
+// fdsPeriods clocks f for cycles and returns the number of times its
+// output rises from zero.
+func fdsPeriods(f *fds, cycles int) int {
+	rises := 0
+	prev := f.Out
+	for i := 0; i < cycles; i++ {
+		f.Clock()
+		if prev == 0 && f.Out != 0 {
+			rises++
+		}
+		prev = f.Out
+	}
+	return rises
+}
+
+// fdsSquare returns an FDS with a square wave at pitch $400, a period of
+// 4096 cycles, starting low.
+func fdsSquare() *fds {
+	f := newFDS()
+	f.Write(0x4089, 0x80)
+	for i := uint16(32); i < 64; i++ {
+		f.Write(0x4040+i, 0x3f)
+	}
+	f.Write(0x4089, 0x00)
+	f.Write(0x4080, 0xa0) // volume 32
+	f.Write(0x4082, 0x00)
+	f.Write(0x4083, 0x04)
+	return f
+}
+
+func TestFDSWave(t *testing.T) {
+	f := fdsSquare()
+	if n := fdsPeriods(f, 10*4096); n != 10 {
+		t.Errorf("%d periods in 10, want 10", n)
+	}
+	if v, _ := f.Read(0x4060); v != 0x3f {
+		t.Errorf("$4060 = %02X, want 3F", v)
+	}
+	if v, _ := f.Read(0x4090); v != 32 {
+		t.Errorf("$4090 = %d, want 32", v)
+	}
+	// The wavetable is protected unless $4089 bit 7 is set.
+	f.Write(0x4060, 0)
+	if f.Wave[32] != 0x3f {
+		t.Error("wavetable written while protected")
+	}
+	// Halting the wave resets it.
+	f.Write(0x4083, 0x84)
+	if n := fdsPeriods(f, 4096); n != 0 || f.WavePos != 0 {
+		t.Errorf("%d periods at %#x while halted", n, f.WavePos)
+	}
+}
+
+func TestFDSMod(t *testing.T) {
+	tests := []struct {
+		counter byte
+		table   byte
+		periods int
+	}{
+		{0, 0, 20},
+		{32, 0, 40},  // pitch doubled
+		{16, 0, 30},  // pitch * 1.5
+		{0x60, 0, 0}, // -32: pitch * 0
+		{32, 4, 20},  // table resets the counter
+	}
+	for _, tc := range tests {
+		f := fdsSquare()
+		f.Write(0x4087, 0x80)
+		for i := 0; i < 32; i++ {
+			f.Write(0x4088, tc.table)
+		}
+		f.Write(0x4084, 0xa0) // mod depth 32
+		f.Write(0x4085, tc.counter)
+		f.Write(0x4086, 0xff)
+		f.Write(0x4087, 0x0f)
+		// Table writes are ignored while the modulator runs.
+		f.Write(0x4088, 7)
+		if f.ModTable[0] != tc.table {
+			t.Errorf("table written while running")
+		}
+		if n := fdsPeriods(f, 20*4096); n != tc.periods {
+			t.Errorf("counter %#x, table %d: %d periods, want %d", tc.counter, tc.table, n, tc.periods)
+		}
+	}
+}
+
+func TestFDSMix(t *testing.T) {
+	for _, chips := range []Chips{0, ChipFDS} {
+		b := testHeader()
+		b[nsfCHIPS] = byte(chips)
+		n, err := ReadNSF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		n.ram.Write(0x4089, 0x80)
+		n.ram.Write(0x4040, 0x3f)
+		n.ram.Write(0x4089, 0x00)
+		n.ram.Write(0x4080, 0xa0)
+		n.ram.Write(0x4082, 0x00)
+		n.ram.Write(0x4083, 0x04)
+		audible := false
+		for _, s := range n.Play(1000) {
+			if s != 0 {
+				audible = true
+			}
+		}
+		if audible != (chips != 0) {
+			t.Errorf("chips %#x: audible %v", chips, audible)
+		}
+	}
+}
+
+func TestFDSBankswitch(t *testing.T) {
+	b := testHeader()
+	b[nsfCHIPS] = byte(ChipFDS)
+	copy(b[nsfBANKSWITCH:], []byte{0, 0, 0, 0, 0, 0, 1, 2})
+	data := make([]byte, 0x3000)
+	data[0x1000] = 0x11
+	data[0x2000] = 0x22
+	b = append(b[:nsfHEADER_LEN], data...)
+	n, err := ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	if v := n.ram.Read(0x6000); v != 0x11 {
+		t.Errorf("$6000 = %02X, want 11", v)
+	}
+	if v := n.ram.Read(0x7000); v != 0x22 {
+		t.Errorf("$7000 = %02X, want 22", v)
+	}
+	n.ram.Write(0x5ff6, 2)
+	if v := n.ram.Read(0x6000); v != 0x22 {
+		t.Errorf("$6000 = %02X after $5FF6, want 22", v)
+	}
+}
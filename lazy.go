@@ -0,0 +1,111 @@
+package nsf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// NewReaderAt reads an NSF or NSFe file of the given size from r. Only the
+// header and metadata are read at first; the program data is read from r
+// when a song is first initialized.
+func NewReaderAt(r io.ReaderAt, size int64) (*NSF, error) {
+	magic, err := readAt(r, 0, min(size, int64(len(nsfMagic))))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(magic, nsfeMagic) {
+		return readNSFEAt(r, size)
+	}
+	return readNSFAt(r, size)
+}
+
+func readNSFAt(r io.ReaderAt, size int64) (*NSF, error) {
+	h, err := readAt(r, 0, min(size, nsfHEADER_LEN))
+	if err != nil {
+		return nil, err
+	}
+	n, dataLen, err := readHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	end := size
+	if dataLen > 0 {
+		end = nsfHEADER_LEN + int64(dataLen)
+		if end > size {
+			return nil, fmt.Errorf("nsf: NSF2 data length %d past end of file", dataLen)
+		}
+		meta, err := readAt(r, end, size-end)
+		if err != nil {
+			return nil, err
+		}
+		if err := n.readChunks(meta, false); err != nil {
+			return nil, err
+		}
+	}
+	n.lazyData = io.NewSectionReader(r, nsfHEADER_LEN, end-nsfHEADER_LEN)
+	return n, nil
+}
+
+func readNSFEAt(r io.ReaderAt, size int64) (*NSF, error) {
+	n := NSF{DMCStealsCycles: true}
+	n.SpeedNTSC = 16666
+	off := int64(len(nsfeMagic))
+	for {
+		h, err := readAt(r, off, 8)
+		if err != nil {
+			return nil, err
+		}
+		chunkSize := int64(binary.LittleEndian.Uint32(h))
+		id := string(h[4:8])
+		if id == "NEND" {
+			if err := n.readChunk(id, nil, true); err != nil {
+				return nil, err
+			}
+			return &n, nil
+		}
+		off += 8
+		if off+chunkSize > size {
+			return nil, ErrTruncatedHeader
+		}
+		var data []byte
+		if id == "DATA" {
+			n.lazyData = io.NewSectionReader(r, off, chunkSize)
+		} else if data, err = readAt(r, off, chunkSize); err != nil {
+			return nil, err
+		}
+		if err := n.readChunk(id, data, true); err != nil {
+			return nil, err
+		}
+		off += chunkSize
+	}
+}
+
+// readAt reads size bytes at off from r. A short read is reported as
+// ErrTruncatedHeader.
+func readAt(r io.ReaderAt, off, size int64) ([]byte, error) {
+	b := make([]byte, size)
+	n, err := r.ReadAt(b, off)
+	if n == len(b) {
+		return b, nil
+	}
+	if err == io.EOF {
+		return nil, ErrTruncatedHeader
+	}
+	return nil, err
+}
+
+// loadData reads the program data of a tune opened with NewReaderAt, if it
+// has not been read.
+func (n *NSF) loadData() error {
+	if n.Data != nil || n.lazyData == nil {
+		return nil
+	}
+	b, err := readAt(n.lazyData, 0, n.lazyData.Size())
+	if err != nil {
+		return err
+	}
+	n.Data = b
+	return nil
+}
@@ -0,0 +1,56 @@
+package nsf
+
+import (
+	"bytes"
+	"hash/fnv"
+	"time"
+)
+
+// EstimateDuration estimates the length of the 1-based song idx for tunes
+// without duration metadata. It plays the song on a copy of n, leaving
+// current playback untouched, until the driver returns to a state it has
+// been in before. The result is the time the loop starts plus one pass
+// through it, or max if no loop is found within max.
+func (n *NSF) EstimateDuration(idx int, max time.Duration) time.Duration {
+	// Copy the configuration of n, but none of the playback state, which
+	// shares memory with n.
+	c := *n
+	c.Cpu, c.ram, c.trace, c.samples = nil, nil, nil, nil
+	c.buf = bytes.Buffer{}
+	if err := c.Init(idx); err != nil {
+		return max
+	}
+	period := c.PlayPeriod()
+	ticksPerPlay := c.cycles(period)
+	seen := map[uint64]int{c.state(): 0}
+	for frame := 1; time.Duration(frame)*period <= max; frame++ {
+		c.playTicks = 0
+		c.call(c.PlayAddr)
+		for c.Cpu.PC != 0 {
+			if c.playTicks > ticksPerPlay*10 {
+				return max
+			}
+			c.step()
+		}
+		for i := ticksPerPlay - c.playTicks; i > 0; i-- {
+			c.Tick()
+		}
+		c.samples = c.samples[:0]
+		h := c.state()
+		if _, ok := seen[h]; ok {
+			return time.Duration(frame) * period
+		}
+		seen[h] = frame
+	}
+	return max
+}
+
+// state returns a hash of the memory a driver keeps its state in: work
+// RAM, the APU registers, and cartridge RAM.
+func (n *NSF) state() uint64 {
+	h := fnv.New64a()
+	h.Write(n.ram.M[:0x800])
+	h.Write(n.ram.M[0x4000:0x4018])
+	h.Write(n.ram.M[0x6000:0x8000])
+	return h.Sum64()
+}
@@ -0,0 +1,91 @@
+package nsf
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Metadata describes a tune and its songs, whether from the NSF header or
+// NSFe chunks.
+type Metadata struct {
+	Title     string
+	Artist    string
+	Copyright string
+	Ripper    string
+	Comment   string
+	Tracks    []TrackMetadata
+}
+
+// TrackMetadata describes a song.
+type TrackMetadata struct {
+	Name string
+	// Duration and Fade are only valid if HasDuration and HasFade are set,
+	// which is when the file gives them.
+	Duration    time.Duration
+	HasDuration bool
+	Fade        time.Duration
+	HasFade     bool
+}
+
+// Metadata returns the metadata of n. NSFe values take precedence over
+// those of the NSF header.
+func (n *NSF) Metadata() Metadata {
+	m := Metadata{
+		Title:     n.Game,
+		Artist:    n.Artist,
+		Copyright: n.Copyright,
+		Ripper:    n.Ripper,
+		Comment:   n.Comment,
+		Tracks:    make([]TrackMetadata, len(n.Songs)),
+	}
+	for i := range m.Tracks {
+		t := &m.Tracks[i]
+		t.Name = n.TrackName(i + 1)
+		t.Duration, t.HasDuration = n.TrackDuration(i + 1)
+		t.Fade, t.HasFade = n.TrackFade(i + 1)
+	}
+	return m
+}
+
+type metadataJSON struct {
+	Title     string
+	Artist    string
+	Copyright string
+	Ripper    string
+	Comment   string
+	// Names, Durations, and Fades have an entry per track, which is null
+	// if absent. Durations and Fades are in milliseconds.
+	Names     []*string
+	Durations []*int64
+	Fades     []*int64
+}
+
+// MarshalJSON encodes m with its tracks as arrays of names, durations, and
+// fades. Durations and fades are integer milliseconds, and absent values
+// are null.
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	j := metadataJSON{
+		Title:     m.Title,
+		Artist:    m.Artist,
+		Copyright: m.Copyright,
+		Ripper:    m.Ripper,
+		Comment:   m.Comment,
+		Names:     make([]*string, len(m.Tracks)),
+		Durations: make([]*int64, len(m.Tracks)),
+		Fades:     make([]*int64, len(m.Tracks)),
+	}
+	for i, t := range m.Tracks {
+		if t.Name != "" {
+			j.Names[i] = &t.Name
+		}
+		if t.HasDuration {
+			ms := t.Duration.Milliseconds()
+			j.Durations[i] = &ms
+		}
+		if t.HasFade {
+			ms := t.Fade.Milliseconds()
+			j.Fades[i] = &ms
+		}
+	}
+	return json.Marshal(j)
+}
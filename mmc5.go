@@ -0,0 +1,100 @@
+package nsf
+
+// mmc5 is the audio of the Nintendo MMC5: two pulse channels like those of
+// the APU but without sweep, and an 8-bit PCM channel.
+type mmc5 struct {
+	S1, S2 square
+	// PCMRead is set if the PCM channel is fed by reads of $8000-$BFFF,
+	// which are not emulated, instead of writes to $5011.
+	PCMRead bool
+	PCM     byte
+
+	Odd   bool
+	Frame int64 // cycles since the last frame step
+}
+
+// mmc5FrameLen is the number of cycles between steps of the MMC5's fixed
+// 240Hz frame counter.
+const mmc5FrameLen = cpuClock / frameRate
+
+func (m *mmc5) Read(v uint16) (byte, bool) {
+	if v != 0x5015 {
+		return 0, false
+	}
+	var b byte
+	if m.S1.length.Counter > 0 {
+		b |= 0x1
+	}
+	if m.S2.length.Counter > 0 {
+		b |= 0x2
+	}
+	return b, true
+}
+
+func (m *mmc5) Write(v uint16, b byte) bool {
+	switch v {
+	case 0x5000:
+		m.S1.Control1(b)
+	case 0x5002:
+		m.S1.Control3(b)
+	case 0x5003:
+		m.S1.Control4(b)
+	case 0x5004:
+		m.S2.Control1(b)
+	case 0x5006:
+		m.S2.Control3(b)
+	case 0x5007:
+		m.S2.Control4(b)
+	case 0x5001, 0x5005:
+		// No sweep units.
+	case 0x5010:
+		m.PCMRead = b&0x1 != 0
+	case 0x5011:
+		// Writes of 0 are ignored.
+		if !m.PCMRead && b != 0 {
+			m.PCM = b
+		}
+	case 0x5015:
+		m.S1.Disable(b&0x1 == 0)
+		m.S2.Disable(b&0x2 == 0)
+	default:
+		return false
+	}
+	return true
+}
+
+func (m *mmc5) Clock() {
+	if m.Odd {
+		if m.S1.Enable {
+			m.S1.Clock()
+		}
+		if m.S2.Enable {
+			m.S2.Clock()
+		}
+	}
+	m.Odd = !m.Odd
+	m.Frame++
+	if m.Frame == mmc5FrameLen {
+		m.Frame = 0
+		// Every step clocks both the envelopes and the length counters.
+		for _, s := range []*square{&m.S1, &m.S2} {
+			s.envelope.Clock()
+			s.length.Clock()
+		}
+	}
+}
+
+// mmc5PulseVolume is square.Volume without the sweep and period muting.
+func mmc5PulseVolume(s *square) uint8 {
+	if s.Enable && s.duty.Enabled() && s.length.Enabled() {
+		return s.envelope.Output()
+	}
+	return 0
+}
+
+// Volume mixes the pulses as the APU does, and the PCM channel at full
+// scale as loud as the DMC at full scale.
+func (m *mmc5) Volume() float32 {
+	p := mmc5PulseVolume(&m.S1) + mmc5PulseVolume(&m.S2)
+	return pulseOut[p] + float32(m.PCM)/255*tndOut[127]
+}
@@ -0,0 +1,95 @@
+package nsf
+
+import "testing"
+
+func TestMMC5Pulse(t *testing.T) {
+	for _, base := range []uint16{0x5000, 0x5004} {
+		m := new(mmc5)
+		s, status := &m.S1, byte(0x1)
+		if base == 0x5004 {
+			s, status = &m.S2, 0x2
+		}
+		m.Write(0x5015, 0x3)
+		m.Write(base, 0xbf)   // duty 50%, constant volume 15
+		m.Write(base+1, 0x8f) // sweep is ignored
+		m.Write(base+2, 0xff)
+		m.Write(base+3, 0x08) // period $0FF, length 254
+		if v, _ := m.Read(0x5015); v != status {
+			t.Errorf("%04X: $5015 = %02X, want %02X", base, v, status)
+		}
+		// Each of the 8 duty steps lasts 2*(period+1) cycles.
+		const cycle = 8 * 2 * 256
+		rises, high := 0, 0
+		prev := mmc5PulseVolume(s)
+		for i := 0; i < 10*cycle; i++ {
+			m.Clock()
+			o := mmc5PulseVolume(s)
+			if o != 0 {
+				high++
+				if prev == 0 {
+					rises++
+				}
+			}
+			prev = o
+		}
+		if rises != 10 {
+			t.Errorf("%04X: %d periods in 10, want 10", base, rises)
+		}
+		if high != 10*cycle/2 {
+			t.Errorf("%04X: high for %d cycles, want %d", base, high, 10*cycle/2)
+		}
+		m.Write(0x5015, 0)
+		if v, _ := m.Read(0x5015); v != 0 || m.Volume() != 0 {
+			t.Errorf("%04X: $5015 = %02X, volume %v after disable", base, v, m.Volume())
+		}
+	}
+}
+
+func TestMMC5PCM(t *testing.T) {
+	m := new(mmc5)
+	m.Write(0x5011, 0x80)
+	if m.PCM != 0x80 {
+		t.Errorf("PCM %02X, want 80", m.PCM)
+	}
+	v := m.Volume()
+	if v <= 0 {
+		t.Errorf("volume %v", v)
+	}
+	m.Write(0x5011, 0)
+	if m.PCM != 0x80 {
+		t.Error("write of 0 not ignored")
+	}
+	m.Write(0x5011, 0xff)
+	if m.Volume() <= v {
+		t.Errorf("volume %v at $FF, not above %v at $80", m.Volume(), v)
+	}
+	m.Write(0x5010, 0x1)
+	m.Write(0x5011, 0x10)
+	if m.PCM != 0xff {
+		t.Error("write in read mode not ignored")
+	}
+}
+
+func TestMMC5Mix(t *testing.T) {
+	for _, chips := range []Chips{0, ChipMMC5} {
+		b := testHeader()
+		b[nsfCHIPS] = byte(chips)
+		n, err := ReadNSF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		n.ram.Write(0x5011, 0x40)
+		audible := false
+		for _, s := range n.Play(1000) {
+			if s != 0 {
+				audible = true
+			}
+		}
+		if audible != (chips != 0) {
+			t.Errorf("chips %#x: audible %v", chips, audible)
+		}
+	}
+}
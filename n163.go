@@ -0,0 +1,40 @@
+package nsf
+
+// n163 is the Namco 163 expansion chip. Its 128 bytes of internal RAM hold
+// the waveforms and channel registers, and are accessed through an address
+// port at $F800-$FFFF and a data port at $4800-$4FFF. Only the RAM
+// interface is emulated; its channels are not mixed into the output.
+type n163 struct {
+	RAM  [0x80]byte
+	Addr byte
+	Inc  bool // increment Addr after each data port access
+}
+
+func (n *n163) Read(v uint16) (byte, bool) {
+	if v&0xf800 != 0x4800 {
+		return 0, false
+	}
+	b := n.RAM[n.Addr]
+	n.next()
+	return b, true
+}
+
+func (n *n163) Write(v uint16, b byte) bool {
+	switch v & 0xf800 {
+	case 0x4800:
+		n.RAM[n.Addr] = b
+		n.next()
+	case 0xf800:
+		n.Addr = b & 0x7f
+		n.Inc = b&0x80 != 0
+	default:
+		return false
+	}
+	return true
+}
+
+func (n *n163) next() {
+	if n.Inc {
+		n.Addr = (n.Addr + 1) & 0x7f
+	}
+}
@@ -0,0 +1,80 @@
+package nsf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/maddyblue/nsf/cpu6502"
+)
+
+func TestN163RAM(t *testing.T) {
+	b := testHeader()
+	b[nsfCHIPS] = byte(ChipN163)
+	n, err := ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	r := n.ram
+	wave := []byte{0x10, 0x32, 0x54, 0x76}
+	r.Write(0xf800, 0x80|0x7e)
+	for _, w := range wave {
+		r.Write(0x4800, w)
+	}
+	r.Write(0xf800, 0x80|0x7e)
+	for i, w := range wave {
+		if got := r.Read(0x4800); got != w {
+			t.Fatalf("read %d: got %02X, want %02X", i, got, w)
+		}
+	}
+	// Without auto-increment the address stays put.
+	r.Write(0xf800, 0x00)
+	for i := 0; i < 2; i++ {
+		if got := r.Read(0x4800); got != wave[2] {
+			t.Fatalf("got %02X, want %02X", got, wave[2])
+		}
+	}
+	if r.M[0xf800] != 0 || r.A.S1.envelope.Volume != 0 {
+		t.Fatal("N163 writes leaked to ROM or APU")
+	}
+}
+
+func TestN163CPU(t *testing.T) {
+	// Stores to the data port must not read it first, which would
+	// increment the address.
+	code, err := cpu6502.Assemble(`
+		LDA #$80
+		STA $F800
+		LDA #$11
+		STA $4800
+		LDA #$22
+		STA $4800
+		LDA #$33
+		STA $4800
+		LDA #$80
+		STA $F800
+		LDA $4800
+		STA $00
+		LDA $4800
+		STA $01
+		LDA $4800
+		STA $02
+		RTS`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := NewRaw(code, 0x8000, 0x8000, 0x8000, 0)
+	n.ExpansionChips = ChipN163
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x11, 0x22, 0x33}
+	if got := n.ram.chips[0].(*n163).RAM[:3]; !bytes.Equal(got, want) {
+		t.Errorf("chip RAM % X, want % X", got, want)
+	}
+	if got := n.ram.M[:3]; !bytes.Equal(got, want) {
+		t.Errorf("read back % X, want % X", got, want)
+	}
+}
@@ -39,6 +39,8 @@ Loop:
 			copy(n.ram.M[a:a+0x4000], n.Data[i*0x4000:(i+1)*0x4000])
 		}
 	}
+	// S is 0 at power on; the reset sequence leaves it at FD.
+	n.Cpu.S = 0
 	n.Cpu.Reset()
 	if n.Cpu.PC == 0 {
 		panic("PC == 0")
@@ -94,3 +96,26 @@ func TestNesTest(t *testing.T) {
 		n.Cpu.Step()
 	}
 }
+
+func TestNesTestLogFormat(t *testing.T) {
+	b, err := os.ReadFile("roms/nestest/nestest.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Split(string(b), "\n")[:200]
+	n := loadNES("roms/nestest/nestest.nes")
+	n.Cpu.PC = 0xC000
+	n.Cpu.LogFormat = cpu6502.LogNestest
+	var buf strings.Builder
+	n.Cpu.SetTraceWriter(&buf)
+	n.Cpu.StepN(len(want))
+	got := strings.Split(buf.String(), "\n")
+	for i, w := range want {
+		g := got[i]
+		// Drop the memory values nestest shows after the operand.
+		text, _, _ := strings.Cut(strings.TrimSpace(w[16:48]), " = ")
+		if g[:16] != w[:16] || g[16:] != text+"  "+w[48:73] {
+			t.Fatalf("line %d:\ngot  %s\nwant %s", i+1, g, w)
+		}
+	}
+}
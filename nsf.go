@@ -1,19 +1,50 @@
 package nsf
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"strings"
 	"time"
 )
 
-var ErrUnrecognized = errors.New("nsf: unrecognized format")
+var (
+	// ErrBadMagic is returned for data that is not an NSF or NSFe file.
+	ErrBadMagic = errors.New("nsf: unrecognized format")
+	// ErrTruncatedHeader is returned for a file that ends within its
+	// header or a chunk.
+	ErrTruncatedHeader = errors.New("nsf: truncated header")
+	// ErrUnsupportedVersion is returned for an NSF file with an unknown
+	// version.
+	ErrUnsupportedVersion = errors.New("nsf: unsupported version")
+	// ErrInitTimeout is returned by Init when the init routine runs for
+	// too long without returning.
+	ErrInitTimeout = errors.New("nsf: init routine did not return")
+	// ErrInitHalted is returned by Init when the init routine halts the
+	// CPU, as by a JAM or a jump to itself.
+	ErrInitHalted = errors.New("nsf: init routine halted")
+	// ErrNonReturningInit is returned by Init for an NSF2 tune with
+	// NSF2NonReturningInit set, which is not supported.
+	ErrNonReturningInit = errors.New("nsf: non-returning init routine not supported")
+	// ErrNoSongs is returned for a file that has no songs.
+	ErrNoSongs = errors.New("nsf: no songs")
+	// ErrBadSong is returned by Init for a song index out of range.
+	ErrBadSong = errors.New("nsf: song index out of range")
+
+	// ErrUnrecognized is the former name of ErrBadMagic.
+	ErrUnrecognized = ErrBadMagic
+)
+
+var (
+	nsfMagic  = []byte("NESM\u001a")
+	nsfeMagic = []byte("NSFE")
+)
 
 const (
 	nsfHEADER_LEN = 0x80
+	nsfVERSION    = 0x5
 	nsfSONGS      = 0x6
 	nsfSTART      = 0x7
 	nsfLOAD       = 0x8
@@ -25,26 +56,138 @@ const (
 	nsfSPEED_NTSC = 0x6e
 	nsfBANKSWITCH = 0x70
 	nsfSPEED_PAL  = 0x78
+	nsfREGION     = 0x7a
+	nsfCHIPS      = 0x7b
+	nsfNSF2       = 0x7c
+	nsfDATA_LEN   = 0x7d
+)
+
+// NSF2Flags are the feature flags of an NSF2 file.
+type NSF2Flags byte
+
+const (
+	// NSF2IRQ marks a tune that may use IRQs. Playback does not provide
+	// the NSF2 IRQ timer yet.
+	NSF2IRQ NSF2Flags = 0x10
+	// NSF2NonReturningInit marks a tune whose init routine does not
+	// return. Playback does not support it yet: Init returns
+	// ErrNonReturningInit.
+	NSF2NonReturningInit NSF2Flags = 0x20
+	// NSF2NoPlay marks a tune without a play routine. Playback still
+	// calls the play address.
+	NSF2NoPlay NSF2Flags = 0x40
+	// NSF2Mandatory marks metadata with a chunk needed for playback.
+	NSF2Mandatory NSF2Flags = 0x80
+)
+
+// Chips is a set of expansion sound chips, as in the chip flags of the
+// NSF header.
+type Chips byte
+
+const (
+	ChipVRC6 Chips = 1 << iota
+	ChipVRC7
+	ChipFDS
+	ChipMMC5
+	ChipN163
+	ChipSunsoft5B
+)
+
+// Device is a sound device, as numbered by the NSFe mixe chunk.
+type Device byte
+
+const (
+	// DeviceAPU1 is the APU pulse channels.
+	DeviceAPU1 Device = iota
+	// DeviceAPU2 is the APU triangle, noise, and DMC channels.
+	DeviceAPU2
+	DeviceVRC6
+	DeviceVRC7
+	DeviceFDS
+	DeviceMMC5
+	DeviceN163
+	DeviceSunsoft5B
 )
 
+// Format is a file format.
+type Format int
+
+const (
+	FormatNSF Format = iota + 1
+	FormatNSFE
+)
+
+// Detect returns the format of the file in r from its magic bytes, and a
+// reader of the whole file. It returns ErrBadMagic for other data.
+func Detect(r io.Reader) (Format, io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(nsfMagic))
+	switch {
+	case bytes.HasPrefix(magic, nsfMagic):
+		return FormatNSF, br, nil
+	case bytes.HasPrefix(magic, nsfeMagic):
+		return FormatNSFE, br, nil
+	case err != nil && err != io.EOF:
+		return 0, br, err
+	}
+	return 0, br, ErrBadMagic
+}
+
+// New reads an NSF or NSFe file from r.
 func New(r io.Reader) (*NSF, error) {
 	b, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	n, err := ReadNSF(b)
-	if err == nil {
-		return n, nil
+	return NewBytes(b)
+}
+
+// NewBytes reads an NSF or NSFe file from b. The returned NSF refers to b,
+// which must not be modified.
+func NewBytes(b []byte) (*NSF, error) {
+	if bytes.HasPrefix(b, nsfeMagic) {
+		return ReadNSFE(b)
 	}
-	return ReadNSFE(b)
+	return ReadNSF(b)
 }
 
 // ReadNSF reads a NSF file from b.
 func ReadNSF(b []byte) (*NSF, error) {
-	if len(b) < nsfHEADER_LEN || !bytes.HasPrefix(b, []byte("NESM\u001a")) {
-		return nil, ErrUnrecognized
+	n, size, err := readHeader(b)
+	if err != nil {
+		return nil, err
 	}
-	var n NSF
+	n.Data = b[nsfHEADER_LEN:]
+	if size > len(n.Data) {
+		return nil, fmt.Errorf("nsf: NSF2 data length %d past end of file", size)
+	}
+	if size > 0 {
+		meta := n.Data[size:]
+		n.Data = n.Data[:size:size]
+		if err := n.readChunks(meta, false); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// readHeader reads the header of an NSF file from b. For NSF2 files, it
+// also returns the length of the program data, which is 0 if the data runs
+// to the end of the file.
+func readHeader(b []byte) (*NSF, int, error) {
+	if !bytes.HasPrefix(b, nsfMagic) {
+		return nil, 0, ErrBadMagic
+	}
+	if len(b) < nsfHEADER_LEN {
+		return nil, 0, ErrTruncatedHeader
+	}
+	if v := b[nsfVERSION]; v < 1 || v > 2 {
+		return nil, 0, ErrUnsupportedVersion
+	}
+	if b[nsfSONGS] == 0 {
+		return nil, 0, ErrNoSongs
+	}
+	n := NSF{DMCStealsCycles: true}
 	n.Songs = make([]Song, int(b[nsfSONGS]))
 	for i := range n.Songs {
 		n.Songs[i] = Song{
@@ -52,96 +195,260 @@ func ReadNSF(b []byte) (*NSF, error) {
 		}
 	}
 	n.Start = b[nsfSTART]
+	n.TotalSongs = b[nsfSONGS]
+	n.StartingSong = b[nsfSTART]
 	n.LoadAddr = bLEtoUint16(b[nsfLOAD:])
 	n.InitAddr = bLEtoUint16(b[nsfINIT:])
 	n.PlayAddr = bLEtoUint16(b[nsfPLAY:])
-	n.Game = bToString(b[nsfSONG:])
-	n.Artist = bToString(b[nsfARTIST:])
-	n.Copyright = bToString(b[nsfCOPYRIGHT:])
+	n.Game = bToString(b[nsfSONG:nsfARTIST])
+	n.Artist = bToString(b[nsfARTIST:nsfCOPYRIGHT])
+	n.Copyright = bToString(b[nsfCOPYRIGHT:nsfSPEED_NTSC])
 	n.SpeedNTSC = bLEtoUint16(b[nsfSPEED_NTSC:])
 	copy(n.Bankswitch[:], b[nsfBANKSWITCH:nsfSPEED_PAL])
-	n.Data = b[nsfHEADER_LEN:]
-	return &n, nil
+	n.SpeedPAL = bLEtoUint16(b[nsfSPEED_PAL:])
+	n.Region, n.Preferred = regionFlags(b[nsfREGION])
+	n.ExpansionChips = Chips(b[nsfCHIPS])
+	n.Version = b[nsfVERSION]
+	var size int
+	if n.Version >= 2 {
+		n.NSF2 = NSF2Flags(b[nsfNSF2])
+		size = int(b[nsfDATA_LEN]) | int(b[nsfDATA_LEN+1])<<8 | int(b[nsfDATA_LEN+2])<<16
+	}
+	return &n, size, nil
+}
+
+// NewRaw returns a single song NSF that loads code at load and calls the
+// init and play routines at the given addresses. It is useful for testing
+// drivers without building an NSF file.
+func NewRaw(code []byte, load, init, play uint16, sampleRate int) *NSF {
+	return &NSF{
+		Songs:           []Song{{Duration: DefaultDuration}},
+		TotalSongs:      1,
+		StartingSong:    1,
+		LoadAddr:        load,
+		InitAddr:        init,
+		PlayAddr:        play,
+		SampleRate:      int64(sampleRate),
+		SpeedNTSC:       16666,
+		Region:          NTSC,
+		Preferred:       NTSC,
+		Data:            code,
+		DMCStealsCycles: true,
+	}
 }
 
 // ReadNSFE reads a NSFE file from b.
 func ReadNSFE(b []byte) (*NSF, error) {
-	if !bytes.HasPrefix(b, []byte("NSFE")) {
-		return nil, ErrUnrecognized
+	if !bytes.HasPrefix(b, nsfeMagic) {
+		return nil, ErrBadMagic
 	}
-	var n NSF
+	n := NSF{DMCStealsCycles: true}
 	n.SpeedNTSC = 16666
-	b = b[4:]
+	if err := n.readChunks(b[4:], true); err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// readChunks reads NSFe chunks from b up to the NEND chunk. If nsfe is
+// false, b is the metadata of an NSF2 file, and the chunks that describe
+// the program are ignored.
+func (n *NSF) readChunks(b []byte, nsfe bool) error {
 	for {
 		if len(b) < 8 {
-			return nil, ErrUnrecognized
+			return ErrTruncatedHeader
 		}
 		size := binary.LittleEndian.Uint32(b)
 		id := string(b[4:8])
-		if id != "INFO" && n.Songs == nil {
-			return nil, fmt.Errorf("nsf: INFO chunk not first")
-		}
 		if id == "NEND" {
-			break
+			return n.readChunk(id, nil, nsfe)
 		}
 		b = b[8:]
 		if uint32(len(b)) < size {
-			return nil, ErrUnrecognized
+			return ErrTruncatedHeader
+		}
+		if err := n.readChunk(id, b[:size], nsfe); err != nil {
+			return err
 		}
-		data := b[:size]
 		b = b[size:]
-		switch id {
-		case "INFO":
-			n.LoadAddr = bLEtoUint16(data)
-			n.InitAddr = bLEtoUint16(data[2:])
-			n.PlayAddr = bLEtoUint16(data[4:])
-			if data[7] != 0 {
-				return nil, fmt.Errorf("nsf: unsupported sound chip: %02x", data[7])
-			}
-			n.Songs = make([]Song, data[8])
-			n.Start = data[9]
-		case "DATA":
-			n.Data = data
-		case "BANK":
-			copy(n.Bankswitch[:], data)
-		case "time":
-			for i := 0; len(data) > 4; data, i = data[4:], i+1 {
-				tm := int32(binary.LittleEndian.Uint32(data))
-				ms := time.Duration(tm) * time.Millisecond
-				n.Songs[i].Duration = ms
+	}
+}
+
+// readChunk reads the NSFe chunk id with the given data.
+func (n *NSF) readChunk(id string, data []byte, nsfe bool) error {
+	if nsfe && id != "INFO" && n.Songs == nil {
+		return fmt.Errorf("nsf: INFO chunk not first")
+	}
+	if !nsfe && (id == "INFO" || id == "DATA" || id == "BANK") {
+		// NSF2 metadata may not replace the header or data.
+		return nil
+	}
+	switch id {
+	case "INFO":
+		info, err := parseInfo(data)
+		if err != nil {
+			return err
+		}
+		if info.Chips&^(ChipVRC6|ChipVRC7|ChipFDS|ChipMMC5|ChipN163) != 0 {
+			return fmt.Errorf("nsf: unsupported sound chip: %02x", info.Chips)
+		}
+		n.Info = &info
+		n.LoadAddr = info.LoadAddr
+		n.InitAddr = info.InitAddr
+		n.PlayAddr = info.PlayAddr
+		n.Region, n.Preferred = regionFlags(info.Region)
+		n.ExpansionChips = info.Chips
+		n.Songs = make([]Song, info.Songs)
+		n.Start = info.Start
+		n.TotalSongs = info.Songs
+		n.StartingSong = info.Start + 1
+	case "DATA":
+		n.Data = data
+	case "BANK":
+		copy(n.Bankswitch[:], data)
+	case "time":
+		for i := 0; len(data) >= 4 && i < len(n.Songs); data, i = data[4:], i+1 {
+			tm := int32(binary.LittleEndian.Uint32(data))
+			if tm < 0 {
+				// The default length.
+				continue
 			}
-		case "fade":
-			for i := 0; len(data) > 4; data, i = data[4:], i+1 {
-				tm := int32(binary.LittleEndian.Uint32(data))
-				ms := time.Duration(tm) * time.Millisecond
-				n.Songs[i].Fade = ms
+			n.Songs[i].Duration = time.Duration(tm) * time.Millisecond
+			n.Songs[i].timed = true
+		}
+	case "fade":
+		for i := 0; len(data) >= 4 && i < len(n.Songs); data, i = data[4:], i+1 {
+			tm := int32(binary.LittleEndian.Uint32(data))
+			if tm < 0 {
+				// The default fade.
+				continue
 			}
-		case "auth":
-			ss := nullStrings(data)
-			if len(ss) != 4 {
-				return nil, fmt.Errorf("nsf: bad auth chunk")
+			n.Songs[i].Fade = time.Duration(tm) * time.Millisecond
+			n.Songs[i].faded = true
+		}
+	case "auth":
+		ss := nullStrings(data)
+		for len(ss) < 4 {
+			ss = append(ss, "")
+		}
+		n.Game = ss[0]
+		n.Artist = ss[1]
+		n.Copyright = ss[2]
+		n.Ripper = ss[3]
+	case "tlbl":
+		ss := nullStrings(data)
+		if len(ss) > len(n.Songs) {
+			return fmt.Errorf("nsf: %d track labels for %d songs", len(ss), len(n.Songs))
+		}
+		for i, s := range ss {
+			n.Songs[i].Name = s
+		}
+	case "plst":
+		n.playlist = make([]int, len(data))
+		for i, idx := range data {
+			if int(idx) >= len(n.Songs) {
+				return fmt.Errorf("nsf: playlist song %d out of range", idx)
 			}
-			n.Game = ss[0]
-			n.Artist = ss[1]
-			n.Copyright = ss[2]
-		case "tlbl":
-			for i, s := range nullStrings(data) {
-				if i >= len(n.Songs) {
-					break
-				}
-				n.Songs[i].Name = s
+			n.playlist[i] = int(idx)
+		}
+	case "regn":
+		// Bit 2 and preferred region 2 are Dendy, which is not supported.
+		// Without a supported region, the region from INFO stands.
+		if len(data) < 1 || Region(data[0])&Dual == 0 {
+			break
+		}
+		n.Region = Region(data[0]) & Dual
+		if len(data) > 1 && data[1] < 2 && NTSC<<data[1]&n.Region != 0 {
+			n.Preferred = NTSC << data[1]
+		} else if n.Preferred&n.Region == 0 {
+			n.Preferred = n.Region &^ PAL
+			if n.Preferred == 0 {
+				n.Preferred = PAL
 			}
-		case "plst", "text":
-			// ignored
-		default:
-			// unknown
 		}
+	case "mixe":
+		if len(data)%3 != 0 {
+			return fmt.Errorf("nsf: mixe chunk is %d bytes, want a multiple of 3", len(data))
+		}
+		n.MixLevels = make(map[Device]float64, len(data)/3)
+		for ; len(data) > 0; data = data[3:] {
+			mb := int16(binary.LittleEndian.Uint16(data[1:]))
+			n.MixLevels[Device(data[0])] = float64(mb) / 100
+		}
+	case "text":
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			data = data[:i]
+		}
+		n.Comment = string(data)
+	default:
+		// unknown
 	}
-	return &n, nil
+	return nil
 }
 
+// NSFEInfo is the INFO chunk of an NSFe file.
+type NSFEInfo struct {
+	LoadAddr uint16
+	InitAddr uint16
+	PlayAddr uint16
+	// Region holds the region flags, as in the NSF header.
+	Region byte
+	Chips  Chips
+	Songs  byte
+	// Start is the 0-based index of the starting song. It is optional and
+	// defaults to 0.
+	Start byte
+}
+
+// parseInfo parses the data of an INFO chunk.
+func parseInfo(data []byte) (NSFEInfo, error) {
+	if len(data) < 9 {
+		return NSFEInfo{}, fmt.Errorf("nsf: INFO chunk is %d bytes, want at least 9", len(data))
+	}
+	info := NSFEInfo{
+		LoadAddr: bLEtoUint16(data),
+		InitAddr: bLEtoUint16(data[2:]),
+		PlayAddr: bLEtoUint16(data[4:]),
+		Region:   data[6],
+		Chips:    Chips(data[7]),
+		Songs:    data[8],
+	}
+	if info.Songs == 0 {
+		return NSFEInfo{}, ErrNoSongs
+	}
+	if len(data) > 9 {
+		info.Start = data[9]
+	}
+	return info, nil
+}
+
+// regionFlags decodes the region byte shared by the NSF header and the NSFe
+// INFO chunk: bit 0 selects PAL, bit 1 marks a dual region tune, in which
+// case bit 0 is the preferred region.
+func regionFlags(b byte) (region, preferred Region) {
+	preferred = NTSC
+	if b&0x1 != 0 {
+		preferred = PAL
+	}
+	region = preferred
+	if b&0x2 != 0 {
+		region = Dual
+	}
+	return
+}
+
+// nullStrings splits b into its null-terminated strings. The last string
+// may be missing its terminator.
 func nullStrings(b []byte) []string {
-	return strings.FieldsFunc(string(b), func(r rune) bool {
-		return r == 0
-	})
+	var ss []string
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			ss = append(ss, string(b))
+			break
+		}
+		ss = append(ss, string(b[:i]))
+		b = b[i+1:]
+	}
+	return ss
 }
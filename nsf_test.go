@@ -1,11 +1,20 @@
 package nsf
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
 	"os"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ebitengine/oto/v3"
+	"github.com/maddyblue/nsf/cpu6502"
 )
 
 func TestNsf(t *testing.T) {
@@ -16,6 +25,1182 @@ func TestNsfe(t *testing.T) {
 	testNsf(t, "mm3.nsfe", 11)
 }
 
+// testHeader returns a minimal single song NSF whose init and play routines
+// return immediately.
+func testHeader() []byte {
+	b := make([]byte, nsfHEADER_LEN+1)
+	copy(b, "NESM\u001a")
+	b[nsfVERSION] = 1
+	b[nsfSONGS] = 1
+	b[nsfSTART] = 1
+	for _, a := range []int{nsfLOAD, nsfINIT, nsfPLAY} {
+		b[a+1] = 0x80
+	}
+	b[nsfSPEED_NTSC] = 0x1a
+	b[nsfSPEED_NTSC+1] = 0x41
+	b[nsfHEADER_LEN] = 0x60 // RTS
+	return b
+}
+
+// nsfeChunk returns an NSFe chunk with the given id and data.
+func nsfeChunk(id string, data []byte) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.LittleEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], id)
+	return append(b, data...)
+}
+
+// testNSFE returns an NSFe file with an INFO chunk for the given number of
+// songs, followed by chunks and an RTS for the init and play routines.
+func testNSFE(songs byte, chunks ...[]byte) []byte {
+	b := []byte("NSFE")
+	b = append(b, nsfeChunk("INFO", []byte{0, 0x80, 0, 0x80, 0, 0x80, 0, 0, songs})...)
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	b = append(b, nsfeChunk("DATA", []byte{0x60})...)
+	return append(b, nsfeChunk("NEND", nil)...)
+}
+
+func TestRegion(t *testing.T) {
+	tests := []struct {
+		flags     byte
+		region    Region
+		preferred Region
+	}{
+		{0x0, NTSC, NTSC},
+		{0x1, PAL, PAL},
+		{0x2, Dual, NTSC},
+		{0x3, Dual, PAL},
+	}
+	for _, tc := range tests {
+		b := testHeader()
+		b[nsfREGION] = tc.flags
+		n, err := ReadNSF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Region != tc.region || n.Preferred != tc.preferred {
+			t.Errorf("%#x: got %v/%v, want %v/%v", tc.flags, n.Region, n.Preferred, tc.region, tc.preferred)
+		}
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		if n.PlayRegion != tc.preferred {
+			t.Errorf("%#x: played %v, want %v", tc.flags, n.PlayRegion, tc.preferred)
+		}
+	}
+
+	b := testHeader()
+	b[nsfREGION] = 0x3
+	n, err := ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.PlayRegion = NTSC
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	if n.PlayRegion != NTSC {
+		t.Errorf("override ignored: played %v", n.PlayRegion)
+	}
+}
+
+func TestPAL(t *testing.T) {
+	for _, tc := range []struct {
+		flags byte
+		plays int
+	}{
+		{0x0, 60},
+		{0x1, 50},
+	} {
+		n := NewRaw([]byte{0x60, 0xe6, 0x00, 0x60}, 0x8000, 0x8000, 0x8001, 0) // RTS; INC $00; RTS
+		n.Region, n.Preferred = regionFlags(tc.flags)
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		n.Play(int(n.SampleRate))
+		if p := int(n.ram.M[0]); p < tc.plays-1 || p > tc.plays+1 {
+			t.Errorf("%#x: %d plays in one second, want %d", tc.flags, p, tc.plays)
+		}
+	}
+}
+
+func TestSpeed(t *testing.T) {
+	for _, tc := range []struct {
+		flags     byte
+		ntsc, pal uint16
+		plays     int
+	}{
+		{0x0, 10000, 0, 100},
+		{0x0, 0, 10000, 60},
+		{0x1, 10000, 40000, 25},
+		{0x1, 10000, 0, 50},
+	} {
+		b := testHeader()
+		b[nsfPLAY] = 0x01
+		b = append(b, 0xe6, 0x00, 0x60) // play: INC $00; RTS
+		b[nsfREGION] = tc.flags
+		binary.LittleEndian.PutUint16(b[nsfSPEED_NTSC:], tc.ntsc)
+		binary.LittleEndian.PutUint16(b[nsfSPEED_PAL:], tc.pal)
+		n, err := ReadNSF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		n.Play(int(n.SampleRate))
+		if p := int(n.ram.M[0]); p < tc.plays-1 || p > tc.plays+1 {
+			t.Errorf("%+v: %d plays in one second (period %v)", tc, p, n.PlayPeriod())
+		}
+	}
+}
+
+func TestExpansionChips(t *testing.T) {
+	b := testHeader()
+	b[nsfCHIPS] = byte(ChipVRC6 | ChipSunsoft5B)
+	n, err := ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.ExpansionChips != ChipVRC6|ChipSunsoft5B {
+		t.Fatalf("chips %#x", n.ExpansionChips)
+	}
+	if !n.HasVRC6() || !n.HasSunsoft5B() {
+		t.Fatal("declared chip not reported")
+	}
+	if n.HasVRC7() || n.HasFDS() || n.HasMMC5() || n.HasN163() {
+		t.Fatal("undeclared chip reported")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"empty", nil, ErrBadMagic},
+		{"magic", []byte("NESM\u001b" + strings.Repeat("\x00", 0x100)), ErrBadMagic},
+		{"short", testHeader()[:0x7f], ErrTruncatedHeader},
+		{"version", append([]byte("NESM\u001a\x03"), make([]byte, 0x100)...), ErrUnsupportedVersion},
+		{"nsfe", testNSFE(1)[:20], ErrTruncatedHeader},
+	}
+	for _, tc := range tests {
+		if _, err := New(bytes.NewReader(tc.b)); err != tc.err {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+	}
+	if ErrUnrecognized != ErrBadMagic {
+		t.Error("ErrUnrecognized is not ErrBadMagic")
+	}
+}
+
+func TestNewBytes(t *testing.T) {
+	for _, name := range []string{"mm3.nsf", "mm3.nsfe"} {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromBytes, err := NewBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fromReader, err := New(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fromBytes, fromReader) {
+			t.Errorf("%s: NewBytes and New differ", name)
+		}
+	}
+}
+
+func TestNewReaderAt(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		idx  int
+	}{
+		{"mm3.nsf", 1},
+		{"mm3.nsfe", 11},
+	} {
+		b, err := os.ReadFile(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eager, err := NewBytes(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lazy, err := NewReaderAt(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lazy.Data != nil {
+			t.Fatalf("%s: data read before Init", tc.name)
+		}
+		if lazy.Game != eager.Game || !reflect.DeepEqual(lazy.Songs, eager.Songs) {
+			t.Fatalf("%s: metadata differs", tc.name)
+		}
+		for _, n := range []*NSF{eager, lazy} {
+			if err := n.Init(tc.idx); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(lazy.Data, eager.Data) {
+			t.Fatalf("%s: data differs", tc.name)
+		}
+		for i := 0; i < 10; i++ {
+			want := eager.Play(4410)
+			if got := lazy.Play(4410); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: samples differ in chunk %d", tc.name, i)
+			}
+		}
+
+		if _, err := NewReaderAt(bytes.NewReader(b[:100]), 100); err != ErrTruncatedHeader {
+			t.Errorf("%s: got %v for short file, want ErrTruncatedHeader", tc.name, err)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	b, err := os.ReadFile("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := n.Metadata()
+	if m.Title != "Mega Man III" || m.Artist != "Yasuaki Fujita" || m.Copyright != "1990 Capcom" || m.Ripper != "" {
+		t.Fatalf("got %+v", m)
+	}
+	if len(m.Tracks) != 57 || m.Tracks[0] != (TrackMetadata{}) {
+		t.Fatalf("got %d tracks, first %+v", len(m.Tracks), m.Tracks[0])
+	}
+
+	if b, err = os.ReadFile("mm3.nsfe"); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = NewBytes(b); err != nil {
+		t.Fatal(err)
+	}
+	m = n.Metadata()
+	if m.Title != "Mega Man III" || m.Artist != "Bunbun" || m.Ripper != "Chris Moeller" {
+		t.Fatalf("got %+v", m)
+	}
+	want := TrackMetadata{
+		Name:        "Intro",
+		Duration:    77 * time.Second,
+		HasDuration: true,
+		Fade:        12 * time.Second,
+		HasFade:     true,
+	}
+	if len(m.Tracks) != 57 || m.Tracks[0] != want {
+		t.Fatalf("got %d tracks, first %+v", len(m.Tracks), m.Tracks[0])
+	}
+}
+
+func TestMixLevels(t *testing.T) {
+	mixe := []byte{
+		byte(DeviceAPU1), 0, 0,
+		byte(DeviceVRC6), 0x26, 0x02, // 550 mB
+		byte(DeviceN163), 0x0c, 0xfe, // -500 mB
+	}
+	n, err := ReadNSFE(testNSFE(1, nsfeChunk("mixe", mixe)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[Device]float64{
+		DeviceAPU1: 0,
+		DeviceVRC6: 5.5,
+		DeviceN163: -5,
+	}
+	if !reflect.DeepEqual(n.MixLevels, want) {
+		t.Fatalf("got %v, want %v", n.MixLevels, want)
+	}
+	if l := n.MixLevels[DeviceFDS]; l != 0 {
+		t.Fatalf("unlisted device at %v dB", l)
+	}
+	if _, err := ReadNSFE(testNSFE(1, nsfeChunk("mixe", mixe[:4]))); err == nil {
+		t.Fatal("expected error for partial entry")
+	}
+
+	// The APU devices scale the pulse and triangle/noise/DMC outputs.
+	for _, d := range []Device{DeviceAPU1, DeviceAPU2} {
+		var peak [2]float32
+		for i, level := range []float64{0, -20} {
+			n, err := ReadNSF(testHeader())
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.MixLevels = map[Device]float64{d: level}
+			if err := n.Init(1); err != nil {
+				t.Fatal(err)
+			}
+			if d == DeviceAPU1 {
+				n.ram.Write(0x4000, 0xbf) // constant volume 15
+				n.ram.Write(0x4002, 0xff)
+				n.ram.Write(0x4003, 0x08)
+			} else {
+				n.ram.Write(0x4011, 0x7f) // DMC level 127
+			}
+			for _, s := range n.Play(1000) {
+				peak[i] = max(peak[i], s, -s)
+			}
+		}
+		if peak[0] == 0 || math.Abs(float64(peak[1]/peak[0])-0.1) > 0.01 {
+			t.Errorf("device %d: peak %v at 0 dB, %v at -20 dB", d, peak[0], peak[1])
+		}
+	}
+}
+
+func TestRegn(t *testing.T) {
+	tests := []struct {
+		regn      []byte
+		region    Region
+		preferred Region
+	}{
+		{[]byte{0x3, 0x1}, Dual, PAL},
+		{[]byte{0x3}, Dual, NTSC},
+		{[]byte{0x2}, PAL, PAL},
+		{[]byte{0x2, 0x0}, PAL, PAL},
+		{[]byte{0x5, 0x2}, NTSC, NTSC},
+	}
+	for _, tc := range tests {
+		n, err := ReadNSFE(testNSFE(1, nsfeChunk("regn", tc.regn)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Region != tc.region || n.Preferred != tc.preferred {
+			t.Errorf("%x: got %v/%v, want %v/%v", tc.regn, n.Region, n.Preferred, tc.region, tc.preferred)
+		}
+	}
+	// A Dendy only regn chunk leaves the region from INFO.
+	for _, regn := range [][]byte{{0x4}, {0x4, 0x2}, {}} {
+		b := testNSFE(1, nsfeChunk("regn", regn))
+		b[len("NSFE")+8+6] = 0x1 // INFO region: PAL
+		n, err := ReadNSFE(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Region != PAL || n.Preferred != PAL {
+			t.Errorf("%x: got %v/%v, want PAL/PAL", regn, n.Region, n.Preferred)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		format Format
+	}{
+		{"mm3.nsf", FormatNSF},
+		{"mm3.nsfe", FormatNSFE},
+	} {
+		b, err := os.ReadFile(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		format, r, err := Detect(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format != tc.format {
+			t.Errorf("%s: got format %v, want %v", tc.name, format, tc.format)
+		}
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rest, b) {
+			t.Errorf("%s: reader does not return the whole file", tc.name)
+		}
+	}
+	for _, b := range []string{"", "NES", "RIFF...."} {
+		if _, _, err := Detect(strings.NewReader(b)); err != ErrBadMagic {
+			t.Errorf("%q: got %v, want ErrBadMagic", b, err)
+		}
+	}
+}
+
+func TestMetadataJSON(t *testing.T) {
+	b, err := os.ReadFile("mm3.nsfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(n.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Title     string
+		Ripper    string
+		Names     []*string
+		Durations []*int64
+		Fades     []*int64
+	}
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Mega Man III" || got.Ripper != "Chris Moeller" {
+		t.Fatalf("got %s", j)
+	}
+	if len(got.Names) != 57 || len(got.Durations) != 57 || len(got.Fades) != 57 {
+		t.Fatalf("got %d names, %d durations, %d fades", len(got.Names), len(got.Durations), len(got.Fades))
+	}
+	if got.Names[0] == nil || *got.Names[0] != "Intro" || got.Durations[0] == nil || *got.Durations[0] != 77000 || got.Fades[0] == nil || *got.Fades[0] != 12000 {
+		t.Fatalf("first track: %s", j)
+	}
+	if !strings.Contains(string(j), `"Durations":[77000,`) {
+		t.Fatalf("durations not integers: %s", j)
+	}
+
+	// Absent values are null.
+	m := Metadata{Tracks: []TrackMetadata{{}}}
+	if j, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(j), `"Names":[null],"Durations":[null],"Fades":[null]`) {
+		t.Fatalf("got %s", j)
+	}
+}
+
+func TestPlayHeadless(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		idx  int
+	}{
+		{"mm3.nsf", 1},
+		{"mm3.nsfe", 11},
+	} {
+		f, err := os.Open(tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := New(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.Init(tc.idx); err != nil {
+			t.Fatal(err)
+		}
+		audible := false
+		// Render five seconds in 100ms chunks.
+		chunk := int(n.SampleRate / 10)
+		for i := 0; i < 50; i++ {
+			samples := n.Play(chunk)
+			if len(samples) != chunk {
+				t.Fatalf("%s: got %d samples, want %d", tc.name, len(samples), chunk)
+			}
+			for _, s := range samples {
+				if math.IsNaN(float64(s)) || math.IsInf(float64(s), 0) {
+					t.Fatalf("%s: non-finite sample %v", tc.name, s)
+				}
+				if s != 0 {
+					audible = true
+				}
+			}
+		}
+		if !audible {
+			t.Errorf("%s: silent", tc.name)
+		}
+	}
+}
+
+func TestNonFinite(t *testing.T) {
+	n, err := ReadNSF(testHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	// Enable every channel with zero periods.
+	for _, r := range []uint16{0x4000, 0x4004, 0x400c} {
+		n.ram.Write(r, 0x3f)
+	}
+	n.ram.Write(0x4008, 0xff)
+	for _, r := range []uint16{0x4003, 0x4007, 0x400b, 0x400f} {
+		n.ram.Write(r, 0x08)
+	}
+	n.append(float32(math.NaN()))
+	n.append(float32(math.Inf(1)))
+	if n.NonFinite != 2 {
+		t.Fatalf("NonFinite = %d, want 2", n.NonFinite)
+	}
+	for _, samples := range [][]float32{n.samples, n.Play(4096)} {
+		for i, s := range samples {
+			if math.IsNaN(float64(s)) || math.IsInf(float64(s), 0) {
+				t.Fatalf("sample %d: non-finite %v", i, s)
+			}
+		}
+	}
+}
+
+func TestBuffered(t *testing.T) {
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	if n.Buffered() != 0 {
+		t.Fatalf("Buffered = %d before Read", n.Buffered())
+	}
+	for i := 0; i < 200; i++ {
+		p := make([]byte, 1000+i*7)
+		if _, err := n.Read(p); err != nil {
+			t.Fatal(err)
+		}
+		if b := n.Buffered(); b > len(p)/4 {
+			t.Fatalf("read %d: %d samples buffered for a %d byte read", i, b, len(p))
+		}
+	}
+}
+
+func TestNewRaw(t *testing.T) {
+	// Play a constant volume square wave on pulse 1.
+	initCode, err := cpu6502.Assemble(`
+		LDA #$BF
+		STA $4000
+		LDA #$FD
+		STA $4002
+		LDA #$08
+		STA $4003
+		RTS`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the note from ending.
+	playCode, err := cpu6502.Assemble(`
+		LDA #$08
+		STA $4003
+		RTS`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playAddr := 0xc000 + uint16(len(initCode))
+	n := NewRaw(append(initCode, playCode...), 0xc000, 0xc000, playAddr, 22050)
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	samples := n.Play(22050 / 10)
+	if len(samples) != 22050/10 {
+		t.Fatalf("got %d samples", len(samples))
+	}
+	audible := false
+	for _, s := range samples {
+		if s != 0 {
+			audible = true
+		}
+	}
+	if !audible {
+		t.Fatal("silent")
+	}
+}
+
+func TestMixDebug(t *testing.T) {
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Debug = true
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	nonzero := false
+	for i := 0; i < 500; i++ {
+		n.Play(100)
+		m := n.MixDebug()
+		if m.Pulse < 0 || m.Pulse > 30 {
+			t.Fatalf("pulse sum %d out of range", m.Pulse)
+		}
+		if m.TND < 0 || m.TND > 202 {
+			t.Fatalf("TND sum %d out of range", m.TND)
+		}
+		if m.Output < 0 || m.Output > 1 {
+			t.Fatalf("output %v out of range", m.Output)
+		}
+		if m.Output != m.PulseOut+m.TNDOut {
+			t.Fatalf("output %v != %v + %v", m.Output, m.PulseOut, m.TNDOut)
+		}
+		if m.Output != 0 {
+			nonzero = true
+		}
+	}
+	if !nonzero {
+		t.Fatal("no samples recorded")
+	}
+}
+
+func TestCPUTrace(t *testing.T) {
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.CPUTrace() != "" {
+		t.Fatal("trace before enabling")
+	}
+	n.EnableCPUTrace(16)
+	for _, song := range []int{1, 2} {
+		if err := n.Init(song); err != nil {
+			t.Fatal(err)
+		}
+		n.Play(int(n.SampleRate) / 10)
+		tr := n.CPUTrace()
+		if lines := strings.Count(tr, "\n"); lines != 16 {
+			t.Fatalf("song %d: got %d trace lines, want 16:%s", song, lines, tr)
+		}
+		if strings.Contains(tr, "0000: 00") {
+			t.Fatalf("song %d: empty trace entries:%s", song, tr)
+		}
+	}
+	n.EnableCPUTrace(0)
+	if n.CPUTrace() != "" {
+		t.Fatal("trace after disabling")
+	}
+}
+
+func TestInitTimeout(t *testing.T) {
+	n := NewRaw([]byte{
+		0xe8,             // init: INX
+		0x4c, 0x00, 0x80, // JMP init
+	}, 0x8000, 0x8000, 0x8000, 0)
+	defer func(c int) { maxInitCycles = c }(maxInitCycles)
+	maxInitCycles = 1000
+	if err := n.Init(1); err != ErrInitTimeout {
+		t.Fatalf("got %v, want ErrInitTimeout", err)
+	}
+
+	// A halted CPU fails without waiting out the timeout.
+	maxInitCycles = 20000000
+	for _, code := range [][]byte{
+		{0x4c, 0x00, 0x80}, // init: JMP init
+		{0x02},             // init: JAM
+	} {
+		n := NewRaw(code, 0x8000, 0x8000, 0x8000, 0)
+		if err := n.Init(1); err != ErrInitHalted {
+			t.Fatalf("% X: got %v, want ErrInitHalted", code, err)
+		}
+		if c := n.Cpu.Cycles; c > 100 {
+			t.Fatalf("% X: halted after %d cycles", code, c)
+		}
+	}
+}
+
+func TestEstimateDuration(t *testing.T) {
+	code := []byte{
+		0x60, // init: RTS
+		// play ($8001): ten frames of intro, then a four frame loop.
+		0xa5, 0x01, // LDA $01
+		0xc9, 0x0a, // CMP #10
+		0xb0, 0x03, // BCS loop
+		0xe6, 0x01, // INC $01
+		0x60,       // RTS
+		0xe6, 0x00, // loop: INC $00
+		0xa5, 0x00, // LDA $00
+		0x29, 0x03, // AND #$03
+		0x85, 0x00, // STA $00
+		0x8d, 0x02, 0x40, // STA $4002
+		0x60, // RTS
+	}
+	n := NewRaw(code, 0x8000, 0x8000, 0x8001, 0)
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	n.Play(1000)
+	cpu, played := n.Cpu, n.played
+
+	period := n.PlayPeriod()
+	// The state after frame 10 recurs after frame 14.
+	if d := n.EstimateDuration(1, time.Minute); d != 14*period {
+		t.Errorf("got %v, want %v", d, 14*period)
+	}
+	if d := n.EstimateDuration(1, 12*period); d != 12*period {
+		t.Errorf("got %v, want max %v", d, 12*period)
+	}
+	if n.Cpu != cpu || n.played != played {
+		t.Error("estimate disturbed playback")
+	}
+
+	// Samples returned by Play before an estimate, and those after it,
+	// match a run without one.
+	var out [2][]float32
+	for i := range out {
+		n := NewRaw(code, 0x8000, 0x8000, 0x8001, 0)
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		n.ram.Write(0x4000, 0xbf) // constant volume 15
+		n.ram.Write(0x4003, 0x0f) // period $7xx
+		first := n.Play(1000)
+		if i == 1 {
+			n.EstimateDuration(1, time.Minute)
+		}
+		out[i] = append(first, n.Play(1000)...)
+	}
+	if !reflect.DeepEqual(out[0], out[1]) {
+		t.Error("estimate changed the output of Play")
+	}
+	if slices.Max(out[0]) == 0 {
+		t.Error("silent")
+	}
+}
+
+func TestPlayCycles(t *testing.T) {
+	code := []byte{
+		0x60,       // init: RTS
+		0xa2, 0x0a, // play: LDX #10
+		0xca,       // DEX
+		0xd0, 0xfd, // BNE -3
+		0x60, // RTS
+	}
+	n := NewRaw(code, 0x8000, 0x8000, 0x8001, 0)
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	if n.LastPlayCycles() != 0 || n.AveragePlayCycles() != 0 {
+		t.Fatal("play cycles before playing")
+	}
+	// 2 + 10*2 + 9*3 + 2 + 6
+	const want = 57
+	for i := 0; i < 10; i++ {
+		n.Play(1000)
+		if c := n.LastPlayCycles(); c != want {
+			t.Fatalf("last play took %d cycles, want %d", c, want)
+		}
+		if a := n.AveragePlayCycles(); a != want {
+			t.Fatalf("average %v cycles, want %d", a, want)
+		}
+	}
+
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err = New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	n.Play(int(n.SampleRate))
+	avg := n.AveragePlayCycles()
+	if n.LastPlayCycles() <= 0 || avg <= 0 {
+		t.Fatalf("last %d, average %v", n.LastPlayCycles(), avg)
+	}
+	n.Play(int(n.SampleRate))
+	if a := n.AveragePlayCycles(); a < avg/2 || a > avg*2 {
+		t.Fatalf("average moved from %v to %v", avg, a)
+	}
+}
+
+func TestTracks(t *testing.T) {
+	f, err := os.Open("mm3.nsfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := n.Tracks()
+	if len(tracks) != len(n.Songs) || len(tracks) == 0 {
+		t.Fatalf("got %d tracks for %d songs", len(tracks), len(n.Songs))
+	}
+	for i, tr := range tracks {
+		if tr.Index != i+1 || tr.Label == "" {
+			t.Errorf("track %d: %+v", i, tr)
+		}
+		if tr.Label != n.Songs[i].Name && n.Songs[i].Name != "" {
+			t.Errorf("track %d: label %q, want %q", i, tr.Label, n.Songs[i].Name)
+		}
+		if tr.Duration != n.Songs[i].Duration || tr.Fade != n.Songs[i].Fade {
+			t.Errorf("track %d: %+v, song %+v", i, tr, n.Songs[i])
+		}
+	}
+
+	raw := NewRaw([]byte{0x60}, 0x8000, 0x8000, 0x8000, 0)
+	if tr := raw.Tracks(); len(tr) != 1 || tr[0].Label != "Track 1" {
+		t.Fatalf("got %+v", tr)
+	}
+}
+
+func TestSongCounts(t *testing.T) {
+	for _, name := range []string{"mm3.nsf", "mm3.nsfe"} {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := New(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.TotalSongs != 57 || n.StartingSong != 1 {
+			t.Errorf("%s: %d songs starting at %d, want 57 starting at 1", name, n.TotalSongs, n.StartingSong)
+		}
+	}
+
+	b := testHeader()
+	b[nsfSONGS] = 3
+	b[nsfSTART] = 2
+	n, err := ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.TotalSongs != 3 || n.StartingSong != 2 {
+		t.Fatalf("%d songs starting at %d, want 3 starting at 2", n.TotalSongs, n.StartingSong)
+	}
+	if n.Start != 2 {
+		t.Fatalf("Start = %d, want the header value 2", n.Start)
+	}
+	for _, song := range []int{0, 4} {
+		if err := n.Init(song); err != ErrBadSong {
+			t.Errorf("Init(%d): got %v, want ErrBadSong", song, err)
+		}
+	}
+	if err := n.Init(3); err != nil || n.Cpu.A != 2 {
+		t.Errorf("Init(3): %v, played song %d", err, n.Cpu.A+1)
+	}
+
+	b[nsfSONGS] = 0
+	if _, err := ReadNSF(b); err != ErrNoSongs {
+		t.Errorf("NSF: got %v, want ErrNoSongs", err)
+	}
+	if _, err := ReadNSFE(testNSFE(0)); err != ErrNoSongs {
+		t.Errorf("NSFe: got %v, want ErrNoSongs", err)
+	}
+}
+
+func TestStrings(t *testing.T) {
+	f, err := os.Open("mm3.nsf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Game != "Mega Man III" || n.Artist != "Yasuaki Fujita" || n.Copyright != "1990 Capcom" {
+		t.Fatalf("got %q, %q, %q", n.Game, n.Artist, n.Copyright)
+	}
+
+	// Fields may fill all 32 bytes, and keep non-ASCII bytes.
+	b := testHeader()
+	copy(b[nsfSONG:], strings.Repeat("x", 32))
+	copy(b[nsfARTIST:], "\xe9t\xe9  ")
+	n, err = ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Game != strings.Repeat("x", 32) || n.Artist != "\xe9t\xe9" || n.Copyright != "" {
+		t.Fatalf("got %q, %q, %q", n.Game, n.Artist, n.Copyright)
+	}
+}
+
+func TestNSFEInfo(t *testing.T) {
+	f, err := os.Open("mm3.nsfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NSFEInfo{
+		LoadAddr: 0x8000,
+		InitAddr: 0x8003,
+		PlayAddr: 0x8000,
+		Songs:    57,
+	}
+	if n.Info == nil || *n.Info != want {
+		t.Fatalf("got %+v, want %+v", n.Info, want)
+	}
+
+	if _, err := ReadNSFE(testNSFE(1)); err != nil {
+		t.Fatal(err)
+	}
+	b := append([]byte("NSFE"), nsfeChunk("INFO", []byte{0, 0x80, 0, 0x80, 0, 0x80, 0, 0})...)
+	b = append(b, nsfeChunk("NEND", nil)...)
+	if _, err := ReadNSFE(b); err == nil || !strings.Contains(err.Error(), "INFO") {
+		t.Fatalf("got %v, want INFO chunk error", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	f, err := os.Open("mm3.nsfe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := New(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Game != "Mega Man III" || n.Artist != "Bunbun" || n.Copyright != "1990 Capcom Co. Ltd." || n.Ripper != "Chris Moeller" {
+		t.Fatalf("got %q, %q, %q, %q", n.Game, n.Artist, n.Copyright, n.Ripper)
+	}
+
+	// The strings stop at the end of the chunk, terminated or not.
+	n, err = ReadNSFE(testNSFE(1, nsfeChunk("auth", []byte("game\x00\x00(c)")), nsfeChunk("text", []byte("more"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Game != "game" || n.Artist != "" || n.Copyright != "(c)" || n.Ripper != "" {
+		t.Fatalf("got %q, %q, %q, %q", n.Game, n.Artist, n.Copyright, n.Ripper)
+	}
+}
+
+func TestTrackName(t *testing.T) {
+	n, err := ReadNSFE(testNSFE(3, nsfeChunk("tlbl", []byte("Intro\x00\x00Boss"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"", "Intro", "", "Boss", ""} {
+		if got := n.TrackName(i); got != want {
+			t.Errorf("track %d: got %q, want %q", i, got, want)
+		}
+	}
+	if _, err := ReadNSFE(testNSFE(1, nsfeChunk("tlbl", []byte("a\x00b\x00")))); err == nil {
+		t.Fatal("expected error for more labels than songs")
+	}
+}
+
+func TestTrackDuration(t *testing.T) {
+	var data []byte
+	for _, ms := range []int32{90000, -1, 1500} {
+		data = binary.LittleEndian.AppendUint32(data, uint32(ms))
+	}
+	n, err := ReadNSFE(testNSFE(4, nsfeChunk("time", data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		idx  int
+		want time.Duration
+		ok   bool
+	}{
+		{1, 90 * time.Second, true},
+		{2, 0, false},
+		{3, 1500 * time.Millisecond, true},
+		{4, 0, false},
+		{5, 0, false},
+	}
+	for _, tc := range tests {
+		if d, ok := n.TrackDuration(tc.idx); d != tc.want || ok != tc.ok {
+			t.Errorf("track %d: got %v, %v; want %v, %v", tc.idx, d, ok, tc.want, tc.ok)
+		}
+	}
+
+	// Durations past the last song are ignored.
+	if _, err := ReadNSFE(testNSFE(1, nsfeChunk("time", data))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrackFade(t *testing.T) {
+	var data []byte
+	for _, ms := range []int32{-1, 0, 2500} {
+		data = binary.LittleEndian.AppendUint32(data, uint32(ms))
+	}
+	n, err := ReadNSFE(testNSFE(3, nsfeChunk("fade", data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		idx  int
+		want time.Duration
+		ok   bool
+	}{
+		{1, 0, false},
+		{2, 0, true},
+		{3, 2500 * time.Millisecond, true},
+		{4, 0, false},
+	}
+	for _, tc := range tests {
+		if d, ok := n.TrackFade(tc.idx); d != tc.want || ok != tc.ok {
+			t.Errorf("track %d: got %v, %v; want %v, %v", tc.idx, d, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	n, err := ReadNSFE(testNSFE(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := n.Playlist(); p != nil {
+		t.Fatalf("got %v without plst chunk", p)
+	}
+	n, err = ReadNSFE(testNSFE(3, nsfeChunk("plst", []byte{2, 0, 2, 1})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, want := n.Playlist(), []int{2, 0, 2, 1}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("got %v, want %v", p, want)
+	}
+	p[0] = 1
+	if p := n.Playlist(); !reflect.DeepEqual(p, want) {
+		t.Fatalf("got %v after modifying the result, want %v", p, want)
+	}
+	if _, err := ReadNSFE(testNSFE(3, nsfeChunk("plst", []byte{0, 3}))); err == nil {
+		t.Fatal("expected error for song out of range")
+	}
+}
+
+func TestComment(t *testing.T) {
+	comment := "Ripped from the cartridge.\nThanks to:\n\tsomeone\n" + strings.Repeat("-", 1000)
+	n, err := ReadNSFE(testNSFE(1, nsfeChunk("text", []byte(comment+"\x00junk"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Comment != comment {
+		t.Fatalf("got %q, want %q", n.Comment, comment)
+	}
+}
+
+func TestNSF2(t *testing.T) {
+	b := testHeader()
+	b[nsfVERSION] = 2
+	b[nsfNSF2] = byte(NSF2IRQ | NSF2NonReturningInit)
+	b[nsfDATA_LEN] = 1
+	b = append(b, nsfeChunk("auth", []byte("game\x00artist\x00c\x00ripper\x00"))...)
+	b = append(b, nsfeChunk("DATA", []byte{0xff, 0xff})...)
+	b = append(b, nsfeChunk("NEND", nil)...)
+	n, err := ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Version != 2 || n.NSF2 != NSF2IRQ|NSF2NonReturningInit {
+		t.Fatalf("version %d, flags %#x", n.Version, n.NSF2)
+	}
+	if len(n.Data) != 1 || n.Data[0] != 0x60 {
+		t.Fatalf("data %x", n.Data)
+	}
+	if n.Game != "game" || n.Ripper != "ripper" {
+		t.Fatalf("got %q, %q", n.Game, n.Ripper)
+	}
+	if err := n.Init(1); err != ErrNonReturningInit {
+		t.Fatalf("got %v, want ErrNonReturningInit", err)
+	}
+	n.NSF2 &^= NSF2NonReturningInit
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 1 files ignore the NSF2 fields.
+	b = testHeader()
+	b[nsfVERSION] = 1
+	b[nsfNSF2] = 0xff
+	b[nsfDATA_LEN] = 0xff
+	if n, err = ReadNSF(b); err != nil {
+		t.Fatal(err)
+	}
+	if n.Version != 1 || n.NSF2 != 0 || len(n.Data) != 1 {
+		t.Fatalf("version %d, flags %#x, %d bytes", n.Version, n.NSF2, len(n.Data))
+	}
+}
+
+func TestBankswitch(t *testing.T) {
+	b := testHeader()
+	b[nsfLOAD] = 0x80
+	b[nsfPLAY] = 0x81
+	copy(b[nsfBANKSWITCH:], []byte{0, 1, 0, 0, 0, 0, 0, 0})
+	code := []byte{
+		0x60,       // init ($8080): RTS
+		0xa9, 0x02, // play: LDA #2
+		0x8d, 0xf9, 0x5f, // STA $5FF9
+		0x60, // RTS
+	}
+	data := make([]byte, 0x3000-0x80)
+	copy(data, code)
+	data[0x1000-0x80] = 0x11
+	data[0x2000-0x80] = 0x22
+	b = append(b[:nsfHEADER_LEN], data...)
+	n, err := ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.Bankswitched() {
+		t.Fatal("not bankswitched")
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	if v := n.ram.Read(0x9000); v != 0x11 {
+		t.Fatalf("$9000 = %02X after init, want 11", v)
+	}
+	if v := n.ram.Read(0x8080); v != 0x60 {
+		t.Fatalf("$8080 = %02X, want 60", v)
+	}
+	n.Play(1000)
+	if v := n.ram.Read(0x9000); v != 0x22 {
+		t.Fatalf("$9000 = %02X after play, want 22", v)
+	}
+	// The ROM has three banks, so bank 3 is empty.
+	n.ram.Write(0x5ff9, 3)
+	if v := n.ram.Read(0x9000); v != 0 {
+		t.Fatalf("$9000 = %02X, want 0", v)
+	}
+}
+
+func TestClip(t *testing.T) {
+	n, err := ReadNSF(testHeader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	n.append(2)
+	if n.ClipCount() != 0 {
+		t.Fatal("clip counted without Debug")
+	}
+	n.Debug = true
+	for _, v := range []float32{1.5, -3, 0.5, 1} {
+		n.append(v)
+	}
+	if n.ClipCount() != 2 {
+		t.Fatalf("ClipCount = %d, want 2", n.ClipCount())
+	}
+	for i, s := range n.samples {
+		if s > 1 || s < -1 {
+			t.Fatalf("sample %d = %v", i, s)
+		}
+	}
+}
+
 func testNsf(t *testing.T, name string, idx int) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -28,7 +1213,9 @@ func testNsf(t *testing.T, name string, idx int) {
 	if n.LoadAddr != 0x8000 || n.InitAddr != 0x8003 || n.PlayAddr != 0x8000 {
 		t.Fatal("bad addresses")
 	}
-	n.Init(idx)
+	if err := n.Init(idx); err != nil {
+		t.Fatal(err)
+	}
 
 	op := &oto.NewContextOptions{}
 	op.SampleRate = int(n.SampleRate)
@@ -0,0 +1,158 @@
+package nsf
+
+// vrc6 is the Konami VRC6 expansion chip, with two pulse channels and a
+// sawtooth channel.
+type vrc6 struct {
+	P1, P2 vrc6Pulse
+	Saw    vrc6Saw
+	// Halt stops all channels, and Shift divides their periods by 16 or
+	// 256, as set by $9003.
+	Halt  bool
+	Shift uint
+}
+
+type vrc6Pulse struct {
+	Mode   bool // output Volume regardless of Duty
+	Duty   byte
+	Volume byte
+	Period uint16
+	Enable bool
+
+	Tick uint16
+	Step byte // duty step, 15 to 0
+}
+
+type vrc6Saw struct {
+	Rate   byte
+	Period uint16
+	Enable bool
+
+	Tick  uint16
+	Step  byte // 0 to 13; Rate is added on even steps
+	Accum byte
+}
+
+func (v *vrc6) Read(uint16) (byte, bool) {
+	return 0, false
+}
+
+func (v *vrc6) Write(a uint16, b byte) bool {
+	switch a {
+	case 0x9000, 0x9001, 0x9002:
+		v.P1.Write(a&0x3, b)
+	case 0x9003:
+		v.Halt = b&0x1 != 0
+		switch {
+		case b&0x4 != 0:
+			v.Shift = 8
+		case b&0x2 != 0:
+			v.Shift = 4
+		default:
+			v.Shift = 0
+		}
+	case 0xa000, 0xa001, 0xa002:
+		v.P2.Write(a&0x3, b)
+	case 0xb000, 0xb001, 0xb002:
+		v.Saw.Write(a&0x3, b)
+	default:
+		return false
+	}
+	return true
+}
+
+func (p *vrc6Pulse) Write(r uint16, b byte) {
+	switch r {
+	case 0:
+		p.Mode = b&0x80 != 0
+		p.Duty = b >> 4 & 0x7
+		p.Volume = b & 0xf
+	case 1:
+		p.Period = p.Period&0xf00 | uint16(b)
+	case 2:
+		p.Period = p.Period&0xff | uint16(b&0xf)<<8
+		p.Enable = b&0x80 != 0
+		if !p.Enable {
+			p.Step = 15
+		}
+	}
+}
+
+func (s *vrc6Saw) Write(r uint16, b byte) {
+	switch r {
+	case 0:
+		s.Rate = b & 0x3f
+	case 1:
+		s.Period = s.Period&0xf00 | uint16(b)
+	case 2:
+		s.Period = s.Period&0xff | uint16(b&0xf)<<8
+		s.Enable = b&0x80 != 0
+		if !s.Enable {
+			s.Step, s.Accum = 0, 0
+		}
+	}
+}
+
+// Clock advances the channels by one CPU cycle.
+func (v *vrc6) Clock() {
+	if v.Halt {
+		return
+	}
+	v.P1.Clock(v.Shift)
+	v.P2.Clock(v.Shift)
+	v.Saw.Clock(v.Shift)
+}
+
+func (p *vrc6Pulse) Clock(shift uint) {
+	if !p.Enable {
+		return
+	}
+	if p.Tick > 0 {
+		p.Tick--
+		return
+	}
+	p.Tick = p.Period >> shift
+	if p.Step == 0 {
+		p.Step = 15
+	} else {
+		p.Step--
+	}
+}
+
+func (s *vrc6Saw) Clock(shift uint) {
+	if !s.Enable {
+		return
+	}
+	if s.Tick > 0 {
+		s.Tick--
+		return
+	}
+	s.Tick = s.Period >> shift
+	s.Step++
+	switch {
+	case s.Step == 14:
+		s.Step, s.Accum = 0, 0
+	case s.Step&1 == 0:
+		s.Accum += s.Rate
+	}
+}
+
+func (p *vrc6Pulse) Output() byte {
+	if p.Enable && (p.Mode || p.Step <= p.Duty) {
+		return p.Volume
+	}
+	return 0
+}
+
+func (s *vrc6Saw) Output() byte {
+	if !s.Enable {
+		return 0
+	}
+	return s.Accum >> 3
+}
+
+// Volume returns the sum of the channels, scaled so that a pulse channel
+// at full volume matches an APU pulse channel at full volume.
+func (v *vrc6) Volume() float32 {
+	sum := v.P1.Output() + v.P2.Output() + v.Saw.Output()
+	return float32(sum) * pulseOut[15] / 15
+}
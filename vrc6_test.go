@@ -0,0 +1,118 @@
+package nsf
+
+import (
+	"math"
+	"testing"
+)
+
+// edges clocks v for cycles and returns the number of times out goes from
+// zero to nonzero, and the number of cycles it is nonzero.
+func edges(v *vrc6, cycles int, out func() byte) (rises, high int) {
+	prev := out()
+	for i := 0; i < cycles; i++ {
+		v.Clock()
+		o := out()
+		if o != 0 {
+			high++
+			if prev == 0 {
+				rises++
+			}
+		}
+		prev = o
+	}
+	return
+}
+
+func TestVRC6Pulse(t *testing.T) {
+	for _, base := range []uint16{0x9000, 0xa000} {
+		v := new(vrc6)
+		p := &v.P1
+		if base == 0xa000 {
+			p = &v.P2
+		}
+		v.Write(base, 0x7f)   // duty 8/16, volume 15
+		v.Write(base+1, 0xff) // period 255
+		v.Write(base+2, 0x80)
+		// Each of the 16 duty steps lasts period+1 cycles.
+		const cycle = 16 * 256
+		rises, high := edges(v, 10*cycle, p.Output)
+		if rises != 10 {
+			t.Errorf("%04X: %d periods in 10, want 10", base, rises)
+		}
+		if high != 10*cycle/2 {
+			t.Errorf("%04X: high for %d cycles, want %d", base, high, 10*cycle/2)
+		}
+		if p.Output() != 0 && p.Output() != 15 {
+			t.Errorf("%04X: output %d", base, p.Output())
+		}
+
+		// Mode ignores the duty cycle.
+		v.Write(base, 0x85)
+		if _, high := edges(v, cycle, p.Output); high != cycle {
+			t.Errorf("%04X: high for %d cycles in mode 1, want %d", base, high, cycle)
+		}
+		v.Write(base+2, 0x00)
+		if p.Output() != 0 {
+			t.Errorf("%04X: output %d while disabled", base, p.Output())
+		}
+	}
+}
+
+func TestVRC6Saw(t *testing.T) {
+	v := new(vrc6)
+	v.Write(0xb000, 42)
+	v.Write(0xb001, 0x0f)
+	v.Write(0xb002, 0x80)
+	// The accumulator resets every 14 steps of period+1 cycles.
+	const cycle = 14 * 16
+	var max byte
+	for i := 0; i < 10*cycle; i++ {
+		v.Clock()
+		if o := v.Saw.Output(); o > max {
+			max = o
+		}
+	}
+	if max != 31 {
+		t.Errorf("peak %d, want 31", max)
+	}
+	if rises, _ := edges(v, 10*cycle, v.Saw.Output); rises != 10 {
+		t.Errorf("%d periods in 10, want 10", rises)
+	}
+	v.Write(0x9003, 0x1)
+	v.Saw.Accum = 0
+	if edges(v, cycle, v.Saw.Output); v.Saw.Accum != 0 {
+		t.Error("saw ran while halted")
+	}
+}
+
+func TestVRC6Mix(t *testing.T) {
+	for _, chips := range []Chips{0, ChipVRC6} {
+		b := testHeader()
+		b[nsfCHIPS] = byte(chips)
+		n, err := ReadNSF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.MixLevels = map[Device]float64{DeviceVRC6: -20}
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		n.ram.Write(0x9000, 0x7f)
+		n.ram.Write(0x9001, 0xff)
+		n.ram.Write(0x9002, 0x80)
+		audible := false
+		for _, s := range n.Play(1000) {
+			if s != 0 {
+				audible = true
+			}
+		}
+		if audible != (chips != 0) {
+			t.Errorf("chips %#x: audible %v", chips, audible)
+		}
+		if chips != 0 {
+			if g := n.ram.voices[0].gain; math.Abs(float64(g)-0.1) > 1e-6 {
+				t.Errorf("gain %v, want 0.1", g)
+			}
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package nsf
+
+import "math"
+
+// VRC7PatchSet selects the dump of the VRC7's built-in instrument ROM used
+// for VRC7 audio. The ROM cannot be read from the chip directly, so several
+// reconstructions exist.
+type VRC7PatchSet int
+
+const (
+	// VRC7Nuke is the set read from a decapped chip by Nuke.YKT in 2019.
+	VRC7Nuke VRC7PatchSet = iota
+	// VRC7Rainwarrior is the set estimated from recordings by rainwarrior
+	// in 2012, used by many older players.
+	VRC7Rainwarrior
+)
+
+// patches returns the 15 built-in instruments of p, in the register layout
+// of the custom instrument at $00-$07. Unknown sets use VRC7Nuke.
+func (p VRC7PatchSet) patches() *[15][8]byte {
+	if p < 0 || int(p) >= len(vrc7Patches) {
+		p = VRC7Nuke
+	}
+	return &vrc7Patches[p]
+}
+
+var vrc7Patches = [...][15][8]byte{
+	VRC7Nuke: {
+		{0x03, 0x21, 0x05, 0x06, 0xe8, 0x81, 0x42, 0x27},
+		{0x13, 0x41, 0x14, 0x0d, 0xd8, 0xf6, 0x23, 0x12},
+		{0x11, 0x11, 0x08, 0x08, 0xfa, 0xb2, 0x20, 0x12},
+		{0x31, 0x61, 0x0c, 0x07, 0xa8, 0x64, 0x61, 0x27},
+		{0x32, 0x21, 0x1e, 0x06, 0xe1, 0x76, 0x01, 0x28},
+		{0x02, 0x01, 0x06, 0x00, 0xa3, 0xe2, 0xf4, 0xf4},
+		{0x21, 0x61, 0x1d, 0x07, 0x82, 0x81, 0x11, 0x07},
+		{0x23, 0x21, 0x22, 0x17, 0xa2, 0x72, 0x01, 0x17},
+		{0x35, 0x11, 0x25, 0x00, 0x40, 0x73, 0x72, 0x01},
+		{0xb5, 0x01, 0x0f, 0x0f, 0xa8, 0xa5, 0x51, 0x02},
+		{0x17, 0xc1, 0x24, 0x07, 0xf8, 0xf8, 0x22, 0x12},
+		{0x71, 0x23, 0x11, 0x06, 0x65, 0x74, 0x18, 0x16},
+		{0x01, 0x02, 0xd3, 0x05, 0xc9, 0x95, 0x03, 0x02},
+		{0x61, 0x63, 0x0c, 0x00, 0x94, 0xc0, 0x33, 0xf6},
+		{0x21, 0x72, 0x0d, 0x00, 0xc1, 0xd5, 0x56, 0x06},
+	},
+	VRC7Rainwarrior: {
+		{0x03, 0x21, 0x04, 0x06, 0x8d, 0xf2, 0x42, 0x17},
+		{0x13, 0x41, 0x05, 0x0e, 0x99, 0x96, 0x63, 0x12},
+		{0x31, 0x11, 0x10, 0x0a, 0xf0, 0x9c, 0x32, 0x02},
+		{0x21, 0x61, 0x1d, 0x07, 0x9f, 0x64, 0x20, 0x27},
+		{0x22, 0x21, 0x1e, 0x06, 0xf0, 0x76, 0x08, 0x28},
+		{0x02, 0x01, 0x06, 0x00, 0xf0, 0xf2, 0x03, 0x95},
+		{0x21, 0x61, 0x1c, 0x07, 0x82, 0x81, 0x16, 0x07},
+		{0x23, 0x21, 0x1a, 0x17, 0xef, 0x82, 0x25, 0x15},
+		{0x25, 0x11, 0x1f, 0x00, 0x86, 0x41, 0x20, 0x11},
+		{0x85, 0x01, 0x1f, 0x0f, 0xe4, 0xa2, 0x11, 0x12},
+		{0x07, 0xc1, 0x2b, 0x45, 0xb4, 0xf1, 0x24, 0xf4},
+		{0x61, 0x23, 0x11, 0x06, 0x96, 0x96, 0x13, 0x16},
+		{0x01, 0x02, 0xd3, 0x05, 0x82, 0xa2, 0x31, 0x51},
+		{0x61, 0x22, 0x0d, 0x02, 0xc3, 0x7f, 0x24, 0x05},
+		{0x21, 0x62, 0x0e, 0x00, 0xa1, 0xa0, 0x44, 0x17},
+	},
+}
+
+// vrc7 is the Konami VRC7 expansion chip, a cut down YM2413 (OPLL) with
+// six two-operator FM channels. Registers are written by selecting them at
+// $9010 and writing the value to $9030. The chip makes a sample every 36
+// CPU cycles, which is modeled here with floating point operators rather
+// than the chip's log-sin tables.
+type vrc7 struct {
+	Addr byte
+	Regs [0x40]byte
+	Ch   [6]vrc7Channel
+
+	patches *[15][8]byte
+	tick    int
+	am, vib float64 // LFO phases, in cycles
+	out     float32
+}
+
+type vrc7Channel struct {
+	Mod, Car vrc7Operator
+	// FB holds the last two modulator outputs, for feedback.
+	FB [2]float64
+}
+
+type vrc7Operator struct {
+	Phase float64 // in cycles
+	Env   float64 // attenuation in dB, 0 to vrc7MaxAtten
+	State vrc7State
+}
+
+type vrc7State byte
+
+const (
+	vrc7Off vrc7State = iota
+	vrc7Attack
+	vrc7Decay
+	vrc7Sustain
+	vrc7Release
+)
+
+const (
+	// vrc7Rate is the sample rate of the chip: 3.58 MHz / 72.
+	vrc7Rate = 3579545.0 / 72
+	// vrc7Cycles is the number of CPU cycles per sample.
+	vrc7Cycles = 36
+	// vrc7MaxAtten is the envelope attenuation, in dB, at which an
+	// operator is silent.
+	vrc7MaxAtten = 48
+)
+
+var (
+	// vrc7Mult is the frequency multiplier of each MULT value.
+	vrc7Mult = [16]float64{0.5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 10, 12, 12, 15, 15}
+	// vrc7KSL is the attenuation in dB at 6 dB per octave for the top four
+	// bits of the frequency number in octave 7.
+	vrc7KSL = [16]float64{0, 18, 24, 27.75, 30, 32.25, 33.75, 35.25, 36, 37.5, 38.25, 39, 39.75, 40.5, 41.25, 42}
+	// vrc7KSLScale scales vrc7KSL for each KSL value: 0, 1.5, 3, and 6
+	// dB per octave.
+	vrc7KSLScale = [4]float64{0, 0.25, 0.5, 1}
+)
+
+func newVRC7(p VRC7PatchSet) *vrc7 {
+	return &vrc7{patches: p.patches()}
+}
+
+func (v *vrc7) Read(uint16) (byte, bool) {
+	return 0, false
+}
+
+func (v *vrc7) Write(a uint16, b byte) bool {
+	switch a {
+	case 0x9010:
+		v.Addr = b
+	case 0x9030:
+		v.write(v.Addr, b)
+	default:
+		return false
+	}
+	return true
+}
+
+func (v *vrc7) write(r, b byte) {
+	if int(r) >= len(v.Regs) {
+		return
+	}
+	old := v.Regs[r]
+	v.Regs[r] = b
+	if r&0xf0 != 0x20 || r&0xf > 5 {
+		return
+	}
+	c := &v.Ch[r&0xf]
+	switch on := b&0x10 != 0; {
+	case on && old&0x10 == 0:
+		c.Mod = vrc7Operator{State: vrc7Attack, Env: vrc7MaxAtten}
+		c.Car = vrc7Operator{State: vrc7Attack, Env: vrc7MaxAtten}
+		c.FB = [2]float64{}
+	case !on && old&0x10 != 0:
+		if c.Mod.State != vrc7Off {
+			c.Mod.State = vrc7Release
+		}
+		if c.Car.State != vrc7Off {
+			c.Car.State = vrc7Release
+		}
+	}
+}
+
+// instrument returns the instrument of channel i.
+func (v *vrc7) instrument(i int) []byte {
+	if n := v.Regs[0x30+i] >> 4; n > 0 {
+		return v.patches[n-1][:]
+	}
+	return v.Regs[:8]
+}
+
+// Clock advances the chip by one CPU cycle.
+func (v *vrc7) Clock() {
+	v.tick++
+	if v.tick < vrc7Cycles {
+		return
+	}
+	v.tick = 0
+	// Tremolo at 3.7 Hz and vibrato at 6.4 Hz.
+	v.am = math.Mod(v.am+3.7/vrc7Rate, 1)
+	v.vib = math.Mod(v.vib+6.4/vrc7Rate, 1)
+	am := 4.8 * (1 - math.Cos(2*math.Pi*v.am)) / 2
+	vib := math.Pow(2, 13.75/1200*math.Sin(2*math.Pi*v.vib))
+	var sum float64
+	for i := range v.Ch {
+		sum += v.sample(i, am, vib)
+	}
+	v.out = float32(sum)
+}
+
+// sample advances channel i by one sample and returns its output.
+func (v *vrc7) sample(i int, am, vib float64) float64 {
+	c := &v.Ch[i]
+	ins := v.instrument(i)
+	fnum := int(v.Regs[0x10+i]) | int(v.Regs[0x20+i]&0x1)<<8
+	block := int(v.Regs[0x20+i] >> 1 & 0x7)
+	sus := v.Regs[0x20+i]&0x20 != 0
+	vol := float64(v.Regs[0x30+i] & 0xf)
+	freq := float64(fnum) * float64(int(1)<<block) / (1 << 19)
+
+	// Key scale level attenuation.
+	ksl := vrc7KSL[fnum>>5] - 6*float64(7-block)
+	if ksl < 0 {
+		ksl = 0
+	}
+
+	// Modulator, with feedback.
+	var fb float64
+	if n := ins[3] & 0x7; n > 0 {
+		fb = (c.FB[0] + c.FB[1]) / 2 * math.Pow(2, float64(n)-6)
+	}
+	mod := c.Mod.output(ins, 0, freq, fnum, block, sus, am, vib, fb,
+		float64(ins[2]&0x3f)*0.75+ksl*vrc7KSLScale[ins[2]>>6])
+	c.FB[1], c.FB[0] = c.FB[0], mod
+
+	// Carrier, phase modulated by up to 4π.
+	return c.Car.output(ins, 1, freq, fnum, block, sus, am, vib, 2*mod,
+		vol*3+ksl*vrc7KSLScale[ins[3]>>6])
+}
+
+// output advances operator o (0 for the modulator, 1 for the carrier) of
+// instrument ins by one sample and returns its output, in [-1, 1].
+// Modulation is a phase offset in cycles, and atten is the attenuation in
+// dB in addition to the envelope.
+func (op *vrc7Operator) output(ins []byte, o int, freq float64, fnum, block int, sus bool, am, vib, modulation, atten float64) float64 {
+	flags := ins[o]
+	inc := freq * vrc7Mult[flags&0xf]
+	if flags&0x40 != 0 {
+		inc *= vib
+	}
+	op.Phase = math.Mod(op.Phase+inc, 1)
+	rks := block<<1 | fnum>>8
+	if flags&0x10 == 0 {
+		rks >>= 2
+	}
+	op.envelope(ins[4+o]>>4, ins[4+o]&0xf, ins[6+o]>>4, ins[6+o]&0xf, rks, flags&0x20 != 0, sus)
+	if op.State == vrc7Off {
+		return 0
+	}
+	atten += op.Env
+	if flags&0x80 != 0 {
+		atten += am
+	}
+	s := math.Sin(2 * math.Pi * (op.Phase + modulation))
+	if s < 0 && ins[3]&(0x8<<o) != 0 {
+		// Half-wave rectified.
+		s = 0
+	}
+	return s * math.Pow(10, -atten/20)
+}
+
+// envelope advances the envelope by one sample given the attack, decay,
+// sustain level, and release values of the operator, its rate key
+// scaling, whether its tone is sustained, and the channel sustain bit.
+func (op *vrc7Operator) envelope(ar, dr, sl, rr byte, rks int, sustained, sus bool) {
+	switch op.State {
+	case vrc7Attack:
+		r := vrc7EnvRate(ar, rks)
+		if r >= 15 {
+			op.Env = 0
+		} else if r > 0 {
+			// 2.83 s from silence to full at rate 1.
+			op.Env -= vrc7MaxAtten / (2.82624 / math.Pow(2, r-1) * vrc7Rate)
+		}
+		if op.Env <= 0 {
+			op.Env = 0
+			op.State = vrc7Decay
+		}
+	case vrc7Decay:
+		op.decay(dr, rks)
+		if op.Env >= float64(sl)*3 {
+			op.State = vrc7Sustain
+		}
+	case vrc7Sustain:
+		if !sustained {
+			op.decay(rr, rks)
+		}
+	case vrc7Release:
+		if sus {
+			rr = 5
+		}
+		op.decay(rr, rks)
+	}
+	if op.Env >= vrc7MaxAtten {
+		op.Env = vrc7MaxAtten
+		op.State = vrc7Off
+	}
+}
+
+// decay increases the attenuation at rate r.
+func (op *vrc7Operator) decay(r byte, rks int) {
+	if rate := vrc7EnvRate(r, rks); rate > 0 {
+		// 19.6 s from full to silence at rate 1.
+		op.Env += vrc7MaxAtten / (19.64032 / math.Pow(2, rate-1) * vrc7Rate)
+	}
+}
+
+// vrc7EnvRate returns the rate r adjusted by the rate key scale rks.
+func vrc7EnvRate(r byte, rks int) float64 {
+	if r == 0 {
+		return 0
+	}
+	return math.Min(15, float64(r)+float64(rks)/4)
+}
+
+// Volume returns the sum of the channels, scaled so that a channel at full
+// volume peaks at the level of an APU pulse channel at full volume.
+func (v *vrc7) Volume() float32 {
+	return v.out * pulseOut[15]
+}
@@ -0,0 +1,135 @@
+package nsf
+
+import "testing"
+
+func TestVRC7PatchSet(t *testing.T) {
+	nuke, rw := VRC7Nuke.patches(), VRC7Rainwarrior.patches()
+	if nuke == rw || nuke[0] == rw[0] {
+		t.Fatal("patch sets share instrument 1")
+	}
+	if VRC7PatchSet(-1).patches() != nuke || VRC7PatchSet(99).patches() != nuke {
+		t.Fatal("unknown patch set does not fall back to VRC7Nuke")
+	}
+	var n NSF
+	if n.VRC7PatchSet != VRC7Nuke {
+		t.Fatal("default patch set is not VRC7Nuke")
+	}
+}
+
+// vrc7Write writes the VRC7 register r.
+func vrc7Write(v *vrc7, r, b byte) {
+	v.Write(0x9010, r)
+	v.Write(0x9030, b)
+}
+
+// vrc7Run clocks v for d seconds.
+func vrc7Run(v *vrc7, d float64) {
+	for i := 0; i < int(d*cpuClock); i++ {
+		v.Clock()
+	}
+}
+
+func TestVRC7Envelope(t *testing.T) {
+	v := newVRC7(VRC7Nuke)
+	for r, b := range []byte{
+		0x21, 0x01, // modulator sustained, carrier percussive
+		0x3f, 0x00, // modulator mostly attenuated
+		0xf0, 0xa4, // carrier attack 10, decay 4
+		0x0f, 0x44, // carrier sustain level 12 dB, release 4
+	} {
+		vrc7Write(v, byte(r), b)
+	}
+	vrc7Write(v, 0x30, 0x00) // custom instrument, full volume
+	vrc7Write(v, 0x10, 0x22)
+	vrc7Write(v, 0x20, 0x19) // key on, octave 4
+	car := &v.Ch[0].Car
+	vrc7Run(v, 0.001)
+	if car.Env <= 0 || car.Env >= vrc7MaxAtten || car.State != vrc7Attack {
+		t.Fatalf("after 1ms: %+v, want attacking", *car)
+	}
+	vrc7Run(v, 0.01)
+	if car.Env > 1 {
+		t.Fatalf("after 11ms: %+v, want full level", *car)
+	}
+	vrc7Run(v, 0.5)
+	if car.Env < 6 {
+		t.Fatalf("after 0.5s: %+v, want decaying", *car)
+	}
+	audible := false
+	for i := 0; i < 1000; i++ {
+		v.Clock()
+		if v.Volume() != 0 {
+			audible = true
+		}
+	}
+	if !audible {
+		t.Fatal("silent while keyed on")
+	}
+	env := car.Env
+	vrc7Write(v, 0x20, 0x09) // key off
+	vrc7Run(v, 0.1)
+	if car.State != vrc7Release || car.Env <= env {
+		t.Fatalf("after key off: %+v, want releasing from %v", *car, env)
+	}
+	vrc7Run(v, 10)
+	if car.State != vrc7Off || v.Volume() != 0 {
+		t.Fatalf("after release: %+v, output %v", *car, v.Volume())
+	}
+}
+
+func TestVRC7PatchSetOutput(t *testing.T) {
+	// Instrument 1 is played through the player, so the NSF field has to
+	// reach the chip.
+	var out [2][]float32
+	for i, p := range []VRC7PatchSet{VRC7Nuke, VRC7Rainwarrior} {
+		b := testHeader()
+		b[nsfCHIPS] = byte(ChipVRC7)
+		n, err := ReadNSF(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.VRC7PatchSet = p
+		if err := n.Init(1); err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range [][2]byte{{0x30, 0x10}, {0x10, 0x22}, {0x20, 0x19}} {
+			n.ram.Write(0x9010, w[0])
+			n.ram.Write(0x9030, w[1])
+		}
+		out[i] = n.Play(4410)
+	}
+	same := true
+	for i := range out[0] {
+		if out[0][i] != out[1][i] {
+			same = false
+		}
+	}
+	if same {
+		t.Fatal("patch sets produce the same output")
+	}
+}
+
+func TestVRC7Mix(t *testing.T) {
+	b := testHeader()
+	b[nsfCHIPS] = byte(ChipVRC7)
+	n, err := ReadNSF(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Init(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range [][2]byte{{0x30, 0x30}, {0x10, 0x22}, {0x20, 0x19}} {
+		n.ram.Write(0x9010, w[0])
+		n.ram.Write(0x9030, w[1])
+	}
+	audible := false
+	for _, s := range n.Play(1000) {
+		if s != 0 {
+			audible = true
+		}
+	}
+	if !audible {
+		t.Fatal("silent")
+	}
+}